@@ -0,0 +1,212 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"hash/fnv"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the collection change tag property
+// http://svn.calendarserver.org/repository/calendarserver/CalendarServer/trunk/doc/Extensions/caldav-ctag.txt
+var ctagName = xml.Name{Space: "http://calendarserver.org/ns/", Local: "getctag"}
+
+// changes made through the server, recorded by the mutating handlers
+type changeTracker struct {
+	mu    sync.Mutex
+	epoch int64
+
+	// change counters of collections
+	counts map[string]uint64
+
+	// journal of changed paths for sync-collection, the
+	// changes up to trimmed have been dropped from it
+	seq     uint64
+	trimmed uint64
+	journal []change
+}
+
+// a single entry of the journal
+type change struct {
+	seq  uint64
+	path string
+}
+
+// modified records a change of the resource at p, e.g. written, created,
+// deleted or its properties patched. The change tags of p, if it is a
+// collection, and all its ancestor collections move.
+func (s *Server) modified(p string) {
+	p = cleanPath(p)
+	dir := s.pathIsDirectory(p)
+
+	c := &s.changes
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record(p, s.syncJournalSize())
+
+	// files have no change tag
+	if dir {
+		c.counts[p]++
+	}
+	for p != "/" {
+		p = path.Dir(p)
+		c.counts[p]++
+	}
+}
+
+// removed records the deletion of the resource at p, or its move elsewhere.
+// The counters of p and its members are dropped, they only grow with the
+// collections that exist.
+func (s *Server) removed(p string) {
+	p = cleanPath(p)
+
+	c := &s.changes
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record(p, s.syncJournalSize())
+
+	for n := range c.counts {
+		if n == p || isDescendant(p, n) {
+			delete(c.counts, n)
+		}
+	}
+	for p != "/" {
+		p = path.Dir(p)
+		c.counts[p]++
+	}
+}
+
+// add a change of p to the journal, keeping at least max changes
+func (c *changeTracker) record(p string, max int) {
+	c.seq++
+	c.journal = append(c.journal, change{seq: c.seq, path: p})
+	// trimmed in chunks
+	if len(c.journal) > 2*max {
+		drop := len(c.journal) - max
+		c.trimmed = c.journal[drop-1].seq
+		c.journal = append(c.journal[:0], c.journal[drop:]...)
+	}
+}
+
+// change tag of the collection p. It moves with every change made through the
+// server, and with members added, removed or modified by others as far as they
+// show up in the listing of p. Tags are not reused after a restart.
+func (s *Server) ctag(p string, fi os.FileInfo) string {
+	s.changes.mu.Lock()
+	count := s.changes.counts[cleanPath(p)]
+	epoch := s.changes.epoch
+	s.changes.mu.Unlock()
+
+	// fingerprint of the listing, independent of the order of entries
+	var sum, n uint64
+	if f, err := s.Fs.Open(p); err == nil {
+		for {
+			entries, err := f.Readdir(walkBatch)
+			for _, e := range entries {
+				if s.hidden(e.Name()) {
+					continue
+				}
+
+				h := fnv.New64a()
+				h.Write([]byte(e.Name()))
+				h.Write([]byte{0})
+				h.Write([]byte(strconv.FormatInt(e.Size(), 16)))
+				h.Write([]byte(strconv.FormatInt(e.ModTime().UnixNano(), 16)))
+				if e.IsDir() {
+					h.Write([]byte{1})
+				}
+
+				sum += h.Sum64()
+				n++
+			}
+
+			if err != nil || len(entries) == 0 {
+				break
+			}
+		}
+		f.Close()
+	}
+
+	return strconv.FormatInt(epoch, 36) + "-" +
+		strconv.FormatUint(count, 36) + "-" +
+		strconv.FormatUint(n, 36) + "-" +
+		strconv.FormatUint(sum, 36) + "-" +
+		strconv.FormatInt(fi.ModTime().UnixNano(), 36)
+}
+
+// start counting changes
+func (c *changeTracker) init() {
+	c.epoch = time.Now().UnixNano()
+	c.counts = map[string]uint64{}
+}
+
+// default number of changes kept for sync-collection
+const defaultSyncJournalSize = 10000
+
+// prefix of sync tokens, they have to be uris
+const syncTokenPrefix = "data:,sync-"
+
+func (s *Server) syncJournalSize() int {
+	if s.SyncJournalSize > 0 {
+		return s.SyncJournalSize
+	}
+	return defaultSyncJournalSize
+}
+
+// sync token of the current state
+func (s *Server) syncToken() string {
+	s.changes.mu.Lock()
+	defer s.changes.mu.Unlock()
+
+	return s.changes.token()
+}
+
+func (c *changeTracker) token() string {
+	return syncTokenPrefix + strconv.FormatInt(c.epoch, 36) + "-" + strconv.FormatUint(c.seq, 36)
+}
+
+// paths changed since token, the members of the collection p up to depth.
+// The token of the current state is returned too. ErrInvalidSyncToken is
+// returned for tokens of another server instance or for changes that are
+// no longer kept.
+func (s *Server) changesSince(p, token string, depth int) ([]string, string, error) {
+	c := &s.changes
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v := strings.SplitN(strings.TrimPrefix(token, syncTokenPrefix), "-", 2)
+	if len(v) != 2 || !strings.HasPrefix(token, syncTokenPrefix) || v[0] != strconv.FormatInt(c.epoch, 36) {
+		return nil, "", ErrInvalidSyncToken
+	}
+	seq, err := strconv.ParseUint(v[1], 36, 64)
+	if err != nil || seq > c.seq || seq < c.trimmed {
+		return nil, "", ErrInvalidSyncToken
+	}
+
+	p = cleanPath(p)
+	seen := map[string]bool{}
+
+	var ret []string
+	for _, e := range c.journal {
+		if e.seq <= seq || seen[e.path] {
+			continue
+		}
+
+		if (depth == InfiniteDepth && isDescendant(p, e.path)) ||
+			(depth == 1 && e.path != p && path.Dir(e.path) == p) {
+			seen[e.path] = true
+			ret = append(ret, e.path)
+		}
+	}
+
+	return ret, c.token(), nil
+}
@@ -0,0 +1,522 @@
+package webdav
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chunked uploads in the style of Nextcloud chunking v2, for files too large
+// to be sent with a single PUT. A session is created by MKCOL of a collection
+// below UploadsPath, the chunks are uploaded into it by PUT with names from
+// 1 to 10000 and assembled in numerical order by a MOVE of its member .file to
+// the destination. Chunks can be listed by PROPFIND to resume an upload, DELETE
+// aborts it.
+// https://docs.nextcloud.com/server/latest/developer_manual/client_apis/WebDAV/chunking.html
+
+// directory of the FileSystem keeping the sessions
+const uploadsDir = ".davuploads"
+
+// sessions without a new chunk for this time are removed, if UploadExpiry is zero
+const defaultUploadExpiry = 24 * time.Hour
+
+// maximum number of chunks of a session
+const maxChunks = 10000
+
+// pseudo member of a session, the assembled file
+const assembledName = ".file"
+
+// is p the directory of the sessions or below it?
+func isUploadsDir(p string) bool {
+	p = strings.TrimPrefix(p, "/")
+	return p == uploadsDir || strings.HasPrefix(p, uploadsDir+"/")
+}
+
+func (s *Server) uploadExpiry() time.Duration {
+	if s.UploadExpiry > 0 {
+		return s.UploadExpiry
+	}
+	return defaultUploadExpiry
+}
+
+// is p below UploadsPath?
+func (s *Server) isUpload(p string) bool {
+	if s.UploadsPath == "" {
+		return false
+	}
+
+	root := cleanPath(s.UploadsPath)
+	return p == root || isDescendant(root, p)
+}
+
+// split p below UploadsPath into the session id and the member name
+func (s *Server) splitUpload(p string) (id, name string) {
+	rel := strings.TrimPrefix(p, cleanPath(s.UploadsPath))
+	id, name, _ = strings.Cut(strings.Trim(rel, "/"), "/")
+	return id, name
+}
+
+// directory of the session id in the FileSystem
+func sessionPath(id string) string {
+	return joinPath("/"+uploadsDir, id)
+}
+
+// a chunk name, a number from 1 to maxChunks
+func chunkNumber(name string) (int, bool) {
+	n, err := strconv.Atoi(name)
+	if err != nil || n < 1 || n > maxChunks || strconv.Itoa(n) != name {
+		return 0, false
+	}
+	return n, true
+}
+
+// info of the unexpired session id
+func (s *Server) session(id string) (os.FileInfo, bool) {
+	fi, err := s.stat(sessionPath(id))
+	if err != nil || !fi.IsDir() {
+		return nil, false
+	}
+
+	if time.Since(fi.ModTime()) > s.uploadExpiry() {
+		s.removeSession(id)
+		return nil, false
+	}
+	return fi, true
+}
+
+// chunks of the session id, in numerical order
+func (s *Server) chunks(id string) ([]os.FileInfo, error) {
+	f, err := s.Fs.Open(sessionPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := f.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []os.FileInfo
+	for _, e := range entries {
+		if _, ok := chunkNumber(e.Name()); ok && !e.IsDir() {
+			ret = append(ret, e)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		a, _ := chunkNumber(ret[i].Name())
+		b, _ := chunkNumber(ret[j].Name())
+		return a < b
+	})
+	return ret, nil
+}
+
+// remove the session id with its chunks
+func (s *Server) removeSession(id string) error {
+	p := sessionPath(id)
+
+	f, err := s.Fs.Open(p)
+	if err != nil {
+		return err
+	}
+	entries, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	// bytes of the chunks freed
+	var freed int64
+	for _, e := range entries {
+		if err := s.Fs.Remove(joinPath(p, e.Name())); err != nil {
+			if !os.IsNotExist(err) {
+				log.Println("DAV:", "removing chunk failed", p, e.Name(), err)
+			}
+		} else if _, ok := chunkNumber(e.Name()); ok && !e.IsDir() {
+			freed += e.Size()
+		}
+	}
+	s.grew(-freed)
+
+	return s.Fs.Remove(p)
+}
+
+// remove sessions that expired
+func (s *Server) removeExpiredUploads() {
+	f, err := s.Fs.Open("/" + uploadsDir)
+	if err != nil {
+		return
+	}
+	entries, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if e.IsDir() && time.Since(e.ModTime()) > s.uploadExpiry() {
+			if err := s.removeSession(e.Name()); err != nil {
+				log.Println("DAV:", "removing upload session failed", e.Name(), err)
+			}
+		}
+	}
+}
+
+// number of bytes stored in all sessions, counted against QuotaLimit
+func (s *Server) uploadBytes() int64 {
+	if s.UploadsPath == "" {
+		return 0
+	}
+
+	f, err := s.Fs.Open("/" + uploadsDir)
+	if err != nil {
+		return 0
+	}
+	entries, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		chunks, _ := s.chunks(e.Name())
+		for _, c := range chunks {
+			size += c.Size()
+		}
+	}
+	return size
+}
+
+// requests below UploadsPath
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request) {
+	id, name := s.splitUpload(s.url2path(r.URL))
+
+	if r.Method == "OPTIONS" {
+		s.doOptions(w, r)
+		return
+	}
+
+	if id == "" || s.hidden(id) || strings.Contains(name, "/") {
+		w.WriteHeader(StatusMethodNotAllowed)
+		return
+	}
+
+	if s.ReadOnly && r.Method != "PROPFIND" {
+		w.WriteHeader(StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == "MKCOL" && name == "":
+		s.createSession(w, r, id)
+	case r.Method == "PUT" && name != "":
+		s.putChunk(w, r, id, name)
+	case r.Method == "MOVE" && name == assembledName:
+		s.assembleUpload(w, r, id)
+	case r.Method == "DELETE" && name == "":
+		if _, ok := s.session(id); !ok {
+			w.WriteHeader(StatusNotFound)
+			return
+		}
+		if err := s.removeSession(id); err != nil {
+			s.writeError(w, statusError(err, onRead))
+			return
+		}
+		w.WriteHeader(StatusNoContent)
+	case r.Method == "PROPFIND" && name == "":
+		s.propfindSession(w, r, id)
+	default:
+		w.WriteHeader(StatusMethodNotAllowed)
+	}
+}
+
+// MKCOL of an upload session, the OC-Total-Length header announces the size of the file
+func (s *Server) createSession(w http.ResponseWriter, r *http.Request, id string) {
+	s.removeExpiredUploads()
+
+	if h := r.Header.Get("Destination"); h != "" {
+		if _, status := s.destination(r, s.url2path(r.URL)); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	if h := r.Header.Get("OC-Total-Length"); h != "" {
+		total, err := strconv.ParseInt(h, 10, 64)
+		if err != nil || total < 0 {
+			w.WriteHeader(StatusBadRequest)
+			return
+		}
+		if !s.quotaAllows(total) {
+			s.writeError(w, NewStatusError(StatusInsufficientStorage, davName("quota-not-exceeded")))
+			return
+		}
+	}
+
+	if _, ok := s.session(id); ok {
+		w.Header().Set("Allow", "OPTIONS, PUT, PROPFIND, DELETE")
+		w.WriteHeader(StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.mkdir(r.Context(), "/"+uploadsDir); err != nil && !os.IsExist(err) {
+		s.writeError(w, statusError(err, onCreate))
+		return
+	}
+	if err := s.mkdir(r.Context(), sessionPath(id)); err != nil {
+		s.writeError(w, statusError(err, onCreate))
+		return
+	}
+
+	w.WriteHeader(StatusCreated)
+}
+
+// PUT of a chunk, it replaces a previous upload of the same chunk
+func (s *Server) putChunk(w http.ResponseWriter, r *http.Request, id, name string) {
+	if _, ok := chunkNumber(name); !ok {
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	if _, ok := s.session(id); !ok {
+		w.WriteHeader(StatusNotFound)
+		return
+	}
+
+	p := joinPath(sessionPath(id), name)
+
+	var oldSize int64
+	fi, err := s.stat(p)
+	exists := err == nil
+	if exists {
+		oldSize = fi.Size()
+	}
+
+	if s.QuotaLimit > 0 {
+		if r.ContentLength < 0 {
+			w.WriteHeader(StatusLengthRequired)
+			return
+		}
+		if !s.quotaAllows(r.ContentLength - oldSize) {
+			s.writeError(w, NewStatusError(StatusInsufficientStorage, davName("quota-not-exceeded")))
+			return
+		}
+	}
+
+	digests, err := newDigester(r.Header)
+	if err != nil {
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	// an interrupted chunk is not kept, it has to be sent again
+	file, err := s.startUpload(r.Context(), p, 0666)
+	if err != nil {
+		s.writeError(w, statusError(err, onCreate))
+		return
+	}
+
+	body := io.Reader(contextReader{r.Context(), r.Body})
+	if r.ContentLength >= 0 {
+		body = io.LimitReader(body, r.ContentLength)
+	}
+
+	// written in place if the FileSystem is no Renamer
+	discard := func() {
+		file.abort()
+		if file.temp == "" {
+			s.Fs.Remove(p)
+			s.grew(-oldSize)
+		}
+	}
+
+	n, err := io.Copy(file, io.TeeReader(body, digests))
+	if err != nil {
+		discard()
+		s.writeError(w, statusError(err, onCreate))
+		return
+	}
+
+	if !digests.verify() {
+		discard()
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	if err := file.commit(); err != nil {
+		discard()
+		s.writeError(w, statusError(err, onCreate))
+		return
+	}
+	s.grew(n - oldSize)
+
+	if exists {
+		w.WriteHeader(StatusNoContent)
+	} else {
+		w.WriteHeader(StatusCreated)
+	}
+}
+
+// MOVE of the .file member, the chunks replace the destination at once
+func (s *Server) assembleUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := s.session(id); !ok {
+		w.WriteHeader(StatusNotFound)
+		return
+	}
+
+	dest, status := s.destination(r, s.url2path(r.URL))
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	if tokens := s.submittedTokens(r); s.isLocked(dest, tokens) || s.isParentLocked(dest, tokens) {
+		s.writeError(w, s.lockError(dest))
+		return
+	}
+
+	var oldSize int64
+	perm := os.FileMode(0666)
+	fi, err := s.stat(dest)
+	exists := err == nil
+	if exists {
+		if fi.IsDir() {
+			w.WriteHeader(StatusConflict)
+			return
+		}
+		if r.Header.Get("Overwrite") == "F" {
+			w.WriteHeader(StatusPreconditionFailed)
+			return
+		}
+		oldSize, perm = fi.Size(), fi.Mode().Perm()
+	} else if !s.pathIsDirectory(parentPath(dest)) {
+		w.WriteHeader(StatusConflict)
+		return
+	}
+
+	chunks, err := s.chunks(id)
+	if err != nil {
+		s.writeError(w, statusError(err, onRead))
+		return
+	}
+
+	var total int64
+	for _, c := range chunks {
+		total += c.Size()
+	}
+
+	if h := r.Header.Get("OC-Total-Length"); h != "" {
+		if want, err := strconv.ParseInt(h, 10, 64); err != nil || want != total {
+			w.WriteHeader(StatusBadRequest)
+			return
+		}
+	}
+
+	// the chunks are already counted against the quota and removed afterwards
+
+	// not verified, the chunks were
+	digests, _ := newDigester(http.Header{})
+
+	file, err := s.startUpload(r.Context(), dest, perm)
+	if err != nil {
+		s.writeError(w, statusError(err, onDestination))
+		return
+	}
+
+	for _, c := range chunks {
+		if err := s.appendChunk(r, file, joinPath(sessionPath(id), c.Name()), digests); err != nil {
+			file.failed(exists)
+			s.writeError(w, statusError(err, onDestination))
+			return
+		}
+	}
+
+	if err := file.commit(); err != nil {
+		file.failed(exists)
+		s.writeError(w, statusError(err, onDestination))
+		return
+	}
+	s.recordChecksums(dest, digests)
+
+	s.modified(dest)
+	s.grew(total - oldSize)
+
+	if err := s.removeSession(id); err != nil {
+		log.Println("DAV:", "removing upload session failed", id, err)
+	}
+
+	if etag := s.etag(dest); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if exists {
+		w.WriteHeader(StatusNoContent)
+	} else {
+		w.WriteHeader(StatusCreated)
+	}
+}
+
+// copy the chunk at p to the end of file
+func (s *Server) appendChunk(r *http.Request, file *upload, p string, digests *digester) error {
+	f, err := s.open(r.Context(), p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(file, io.TeeReader(contextReader{r.Context(), f}, digests))
+	return err
+}
+
+// PROPFIND of a session lists its chunks, to resume an upload
+func (s *Server) propfindSession(w http.ResponseWriter, r *http.Request, id string) {
+	fi, ok := s.session(id)
+	if !ok {
+		w.WriteHeader(StatusNotFound)
+		return
+	}
+
+	var pf PropFind
+	if err := newXmlDecoder(r.Body).Decode(&pf); err == io.EOF {
+		pf.AllProp = &struct{}{}
+	} else if err != nil {
+		s.writeError(w, bodyError(err))
+		return
+	}
+
+	root := joinPath(cleanPath(s.UploadsPath), id)
+
+	ms := NewMultiStatusWriter(w)
+	if err := ms.Write(Response{
+		Href:     []string{s.href(root, true)},
+		Propstat: s.propfindPropstats(&pf, sessionPath(id), fi),
+	}); err != nil {
+		return
+	}
+
+	if r.Header.Get("Depth") != "0" {
+		chunks, _ := s.chunks(id)
+		for _, c := range chunks {
+			if err := ms.Write(Response{
+				Href:     []string{s.href(path.Join(root, c.Name()), false)},
+				Propstat: s.propfindPropstats(&pf, joinPath(sessionPath(id), c.Name()), c),
+			}); err != nil {
+				return
+			}
+		}
+	}
+
+	ms.Close()
+}
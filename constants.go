@@ -3,6 +3,7 @@ package webdav
 import (
 	"errors"
 	"net/http"
+	"strconv"
 )
 
 // status codes
@@ -27,7 +28,10 @@ const (
 	StatusConflict             = http.StatusConflict
 	StatusPreconditionFailed   = http.StatusPreconditionFailed
 	StatusRequestTooLong       = http.StatusRequestEntityTooLarge
+	StatusRequestURITooLong    = http.StatusRequestURITooLong
 	StatusUnsupportedMediaType = http.StatusUnsupportedMediaType
+	StatusLengthRequired       = http.StatusLengthRequired
+	StatusRangeNotSatisfiable  = http.StatusRequestedRangeNotSatisfiable
 )
 
 // extended status codes, http://www.webdav.org/specs/rfc4918.html#status.code.extensions.to.http11
@@ -57,9 +61,22 @@ func StatusText(code int) string {
 	return http.StatusText(code)
 }
 
+// StatusLine returns the status line of the code as used in multistatus responses, e.g. "HTTP/1.1 200 OK".
+func StatusLine(code int) string {
+	return "HTTP/1.1 " + strconv.Itoa(code) + " " + StatusText(code)
+}
+
 // internal error variables
 var (
 	ErrInvalidCharPath = errors.New("invalid character in file path")
 	ErrNotImplemented  = errors.New("feature not yet implemented")
 	ErrMalformedXml    = errors.New("xml is not well-formed")
+	ErrLocked          = errors.New("resource is locked")
+	ErrNoSuchLock      = errors.New("no such lock")
+	ErrNoSuchProperty  = errors.New("no such property")
+
+	ErrXattrNotSupported  = errors.New("extended attributes not supported")
+	ErrInvalidDestination = errors.New("invalid destination")
+	ErrInvalidSyncToken   = errors.New("invalid sync token")
+	ErrExternalEntity     = errors.New("external entities are not allowed")
 )
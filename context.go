@@ -0,0 +1,72 @@
+package webdav
+
+import (
+	"context"
+	"io"
+)
+
+// open path, the FileSystem is asked to honor ctx if it is a ContextFileSystem
+func (s *Server) open(ctx context.Context, path string) (File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cfs, ok := s.Fs.(ContextFileSystem); ok {
+		return cfs.OpenContext(ctx, path)
+	}
+	return s.Fs.Open(path)
+}
+
+// create or truncate path
+func (s *Server) create(ctx context.Context, path string) (File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cfs, ok := s.Fs.(ContextFileSystem); ok {
+		return cfs.CreateContext(ctx, path)
+	}
+	return s.Fs.Create(path)
+}
+
+// create the directory path
+func (s *Server) mkdir(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cfs, ok := s.Fs.(ContextFileSystem); ok {
+		return cfs.MkdirContext(ctx, path)
+	}
+	return s.Fs.Mkdir(path)
+}
+
+// remove the file or empty directory path
+func (s *Server) remove(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cfs, ok := s.Fs.(ContextFileSystem); ok {
+		return cfs.RemoveContext(ctx, path)
+	}
+	return s.Fs.Remove(path)
+}
+
+// status of a request stopped because its context is done, 0 if it is not
+func contextStatus(ctx context.Context) int {
+	if ctx.Err() != nil {
+		return StatusServiceUnavailable
+	}
+	return 0
+}
+
+// a reader that fails as soon as its context is done,
+// stops copying of large files
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,217 @@
+package webdav
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// checksums of a file as recorded by PUT, in the format of ownCloud
+// e.g. <oc:checksum>SHA256:... MD5:...</oc:checksum>
+var checksumsName = xml.Name{Space: "http://owncloud.org/ns", Local: "checksums"}
+
+var errInvalidDigest = errors.New("invalid digest")
+
+// supported digest algorithms by their lower case names in the Digest and
+// Repr-Digest headers, with the names used in checksums
+var digestAlgorithms = map[string]struct {
+	new      func() hash.Hash
+	checksum string
+}{
+	"sha-256": {sha256.New, "SHA256"},
+	"sha-512": {sha512.New, "SHA512"},
+	"md5":     {md5.New, "MD5"},
+}
+
+// always computed and recorded, other algorithms only if they are verified
+var recordedDigests = []string{"sha-256", "md5"}
+
+// A digester hashes the content written to it and
+// verifies it against the digests sent by the client.
+type digester struct {
+	hashes map[string]hash.Hash
+	want   map[string][]byte
+}
+
+// parse the digests of the request body, unknown algorithms are ignored
+// http://tools.ietf.org/html/rfc3230#section-4.3.2
+// http://tools.ietf.org/html/rfc9530#section-3
+// http://tools.ietf.org/html/rfc1864
+func newDigester(h http.Header) (*digester, error) {
+	d := &digester{
+		hashes: map[string]hash.Hash{},
+		want:   map[string][]byte{},
+	}
+
+	want := func(alg, value string) error {
+		if _, ok := digestAlgorithms[alg]; !ok {
+			return nil
+		}
+
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return errInvalidDigest
+		}
+
+		// the same algorithm in different headers has to agree
+		if old, ok := d.want[alg]; ok && !bytes.Equal(old, sum) {
+			return errInvalidDigest
+		}
+		d.want[alg] = sum
+		return nil
+	}
+
+	//	Digest = "Digest" ":" #(instance-digest)
+	//	instance-digest = digest-algorithm "=" <encoded digest output>
+	for _, v := range h.Values("Digest") {
+		for _, e := range strings.Split(v, ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(e), "=")
+			if !ok {
+				return nil, errInvalidDigest
+			}
+			if err := want(strings.ToLower(alg), value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// structured field dictionaries of byte sequences, e.g. sha-256=:...:
+	for _, name := range []string{"Repr-Digest", "Content-Digest"} {
+		for _, v := range h.Values(name) {
+			for _, e := range strings.Split(v, ",") {
+				alg, value, ok := strings.Cut(strings.TrimSpace(e), "=")
+				if !ok {
+					return nil, errInvalidDigest
+				}
+				value, _, _ = strings.Cut(value, ";")
+				if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+					return nil, errInvalidDigest
+				}
+				if err := want(alg, value[1:len(value)-1]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if v := h.Get("Content-MD5"); v != "" {
+		if err := want("md5", strings.TrimSpace(v)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, alg := range recordedDigests {
+		d.hashes[alg] = digestAlgorithms[alg].new()
+	}
+	for alg := range d.want {
+		if _, ok := d.hashes[alg]; !ok {
+			d.hashes[alg] = digestAlgorithms[alg].new()
+		}
+	}
+
+	return d, nil
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	for _, h := range d.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// were digests sent by the client?
+func (d *digester) verifying() bool {
+	return len(d.want) != 0
+}
+
+// does the content match all digests sent by the client?
+func (d *digester) verify() bool {
+	for alg, sum := range d.want {
+		if !bytes.Equal(d.hashes[alg].Sum(nil), sum) {
+			return false
+		}
+	}
+	return true
+}
+
+// checksums property of the content
+func (d *digester) property() Property {
+	var sums []string
+	for _, alg := range recordedDigests {
+		sums = append(sums, digestAlgorithms[alg].checksum+":"+hex.EncodeToString(d.hashes[alg].Sum(nil)))
+	}
+
+	v := struct {
+		XMLName  xml.Name `xml:"http://owncloud.org/ns checksum"`
+		Checksum string   `xml:",chardata"`
+	}{Checksum: strings.Join(sums, " ")}
+
+	b, _ := xml.Marshal(v)
+	return Property{Name: checksumsName, InnerXML: string(b)}
+}
+
+// record the checksums of the new content of path
+func (s *Server) recordChecksums(path string, d *digester) {
+	s.propMu.Lock()
+	defer s.propMu.Unlock()
+
+	if err := s.Props.Set(path, d.property()); err != nil {
+		log.Println("DAV:", "recording checksums failed", path, err)
+	}
+}
+
+// drop the recorded checksums of path, e.g. after a partial update
+func (s *Server) forgetChecksums(path string) {
+	s.propMu.Lock()
+	defer s.propMu.Unlock()
+
+	if err := s.Props.Remove(path, checksumsName); err != nil {
+		log.Println("DAV:", "removing checksums failed", path, err)
+	}
+}
+
+// Digest and Repr-Digest response headers with the recorded checksums of path
+func (s *Server) setDigestHeaders(w http.ResponseWriter, path string) {
+	prop, err := s.Props.Get(path, checksumsName)
+	if err != nil {
+		return
+	}
+
+	var v struct {
+		Checksum string `xml:"http://owncloud.org/ns checksum"`
+	}
+	if err := xml.Unmarshal([]byte("<checksums>"+prop.InnerXML+"</checksums>"), &v); err != nil {
+		return
+	}
+
+	var digest, repr []string
+	for _, c := range strings.Fields(v.Checksum) {
+		name, value, _ := strings.Cut(c, ":")
+		sum, err := hex.DecodeString(value)
+		if err != nil {
+			continue
+		}
+
+		for alg, a := range digestAlgorithms {
+			if a.checksum == name {
+				b := base64.StdEncoding.EncodeToString(sum)
+				digest = append(digest, strings.ToUpper(alg)+"="+b)
+				repr = append(repr, alg+"=:"+b+":")
+			}
+		}
+	}
+
+	if len(digest) != 0 {
+		w.Header().Set("Digest", strings.Join(digest, ","))
+		w.Header().Set("Repr-Digest", strings.Join(repr, ", "))
+	}
+}
@@ -0,0 +1,99 @@
+package webdav
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestDigester(t *testing.T) {
+	body := []byte("hello world")
+	sha256sum := sha256.Sum256(body)
+	sha512sum := sha512.Sum512(body)
+	md5sum := md5.Sum(body)
+
+	sha256b64 := base64.StdEncoding.EncodeToString(sha256sum[:])
+	sha512b64 := base64.StdEncoding.EncodeToString(sha512sum[:])
+	md5b64 := base64.StdEncoding.EncodeToString(md5sum[:])
+	other := base64.StdEncoding.EncodeToString([]byte("other"))
+
+	tests := []struct {
+		header    http.Header
+		ok        bool
+		verifying bool
+		verify    bool
+	}{
+		{http.Header{}, true, false, true},
+		{http.Header{"Digest": {"SHA-256=" + sha256b64}}, true, true, true},
+		{http.Header{"Digest": {"sha-256=" + sha256b64}}, true, true, true},
+		{http.Header{"Digest": {"SHA-512=" + sha512b64 + ", MD5=" + md5b64}}, true, true, true},
+		{http.Header{"Digest": {"SHA-256=" + other}}, true, true, false},
+		{http.Header{"Digest": {"SHA-256=" + sha256b64 + ",MD5=" + other}}, true, true, false},
+		{http.Header{"Digest": {"UNIXsum=30637"}}, true, false, true},
+		{http.Header{"Digest": {"SHA-256"}}, false, false, false},
+		{http.Header{"Digest": {"SHA-256=%%%"}}, false, false, false},
+
+		{http.Header{"Repr-Digest": {"sha-256=:" + sha256b64 + ":"}}, true, true, true},
+		{http.Header{"Content-Digest": {"sha-512=:" + sha512b64 + ":;x=1"}}, true, true, true},
+		{http.Header{"Repr-Digest": {"sha-256=:" + other + ":"}}, true, true, false},
+		{http.Header{"Repr-Digest": {"sha-256=" + sha256b64}}, false, false, false},
+		{http.Header{"Repr-Digest": {"unixsum=:" + other + ":"}}, true, false, true},
+
+		{http.Header{"Content-Md5": {md5b64}}, true, true, true},
+		{http.Header{"Content-Md5": {other}}, true, true, false},
+
+		// the same algorithm in different headers
+		{http.Header{"Digest": {"SHA-256=" + sha256b64}, "Repr-Digest": {"sha-256=:" + sha256b64 + ":"}}, true, true, true},
+		{http.Header{"Digest": {"SHA-256=" + sha256b64}, "Repr-Digest": {"sha-256=:" + other + ":"}}, false, false, false},
+		{http.Header{"Digest": {"MD5=" + md5b64}, "Content-Md5": {other}}, false, false, false},
+	}
+
+	for _, tt := range tests {
+		d, err := newDigester(tt.header)
+		if (err == nil) != tt.ok {
+			t.Errorf("newDigester(%v) error %v, want ok %v", tt.header, err, tt.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if got := d.verifying(); got != tt.verifying {
+			t.Errorf("newDigester(%v).verifying() = %v, want %v", tt.header, got, tt.verifying)
+		}
+
+		d.Write(body[:5])
+		d.Write(body[5:])
+		if got := d.verify(); got != tt.verify {
+			t.Errorf("newDigester(%v).verify() = %v, want %v", tt.header, got, tt.verify)
+		}
+	}
+}
+
+func TestDigesterProperty(t *testing.T) {
+	body := []byte("hello world")
+	sha256sum := sha256.Sum256(body)
+	md5sum := md5.Sum(body)
+
+	// checksums are recorded whether or not they were verified
+	d, err := newDigester(http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Write(body)
+
+	p := d.property()
+	if p.Name != checksumsName {
+		t.Errorf("property name %v, want %v", p.Name, checksumsName)
+	}
+
+	want := "<checksum xmlns=\"http://owncloud.org/ns\">SHA256:" + hex.EncodeToString(sha256sum[:]) +
+		" MD5:" + hex.EncodeToString(md5sum[:]) + "</checksum>"
+	if p.InnerXML != want {
+		t.Errorf("property %q, want %q", p.InnerXML, want)
+	}
+}
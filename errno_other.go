@@ -0,0 +1,33 @@
+//go:build !plan9
+
+package webdav
+
+import (
+	"errors"
+	"syscall"
+)
+
+// status of errno values of the FileSystem, nil if err is none of them
+func errnoStatus(err error, on errorStatuses) *StatusError {
+	switch {
+	case errors.Is(err, syscall.EROFS):
+		return &StatusError{Status: StatusForbidden}
+
+	// http://tools.ietf.org/html/rfc4331#section-6
+	case errors.Is(err, syscall.EDQUOT):
+		return NewStatusError(StatusInsufficientStorage, davName("quota-not-exceeded"))
+	case errors.Is(err, syscall.ENOSPC):
+		return NewStatusError(StatusInsufficientStorage, davName("sufficient-disk-space"))
+
+	case errors.Is(err, syscall.ENAMETOOLONG):
+		return &StatusError{Status: on.nameTooLong}
+	case errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.ENOTEMPTY):
+		return &StatusError{Status: StatusConflict}
+	}
+	return nil
+}
+
+// did a rename fail because source and destination are on different devices?
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,18 @@
+package webdav
+
+import (
+	"errors"
+	"os"
+)
+
+// errors of plan9 are plain strings, only those of io/fs are translated
+
+func errnoStatus(err error, on errorStatuses) *StatusError {
+	return nil
+}
+
+// renames are limited to a single directory, anything else is copied
+func isCrossDevice(err error) bool {
+	var le *os.LinkError
+	return errors.As(err, &le)
+}
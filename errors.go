@@ -0,0 +1,105 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"strings"
+)
+
+// A StatusError fails a request with a specific status. It can be returned
+// by a FileSystem or PropertyStore, the Conditions are the failed
+// preconditions or postconditions sent in an error body.
+// http://www.webdav.org/specs/rfc4918.html#precondition.postcondition.xml.elements
+type StatusError struct {
+	Status     int
+	Conditions []Condition
+}
+
+// NewStatusError returns an error with a single condition, the hrefs
+// are the urls of the resources involved, e.g. of the conflicting locks.
+func NewStatusError(status int, condition xml.Name, hrefs ...string) *StatusError {
+	return &StatusError{
+		Status:     status,
+		Conditions: []Condition{{XMLName: condition, Href: hrefs}},
+	}
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Conditions) != 0 {
+		return strings.ToLower(StatusText(e.Status)) + ": " + e.Conditions[0].XMLName.Local
+	}
+	return strings.ToLower(StatusText(e.Status))
+}
+
+// statuses of errors whose meaning depends on the failed operation
+type errorStatuses struct {
+	// missing resource, or missing parent of a created one
+	notExist int
+
+	// resource exists but must not
+	exist int
+
+	// name of the resource is too long
+	nameTooLong int
+}
+
+var (
+	// reading or removing the resource of the Request-URI
+	onRead = errorStatuses{notExist: StatusNotFound, exist: StatusConflict, nameTooLong: StatusRequestURITooLong}
+
+	// creating the resource of the Request-URI
+	onCreate = errorStatuses{notExist: StatusConflict, exist: StatusMethodNotAllowed, nameTooLong: StatusRequestURITooLong}
+
+	// creating the Destination of COPY or MOVE
+	onDestination = errorStatuses{notExist: StatusConflict, exist: StatusPreconditionFailed, nameTooLong: StatusBadRequest}
+)
+
+// statusError translates an error of the FileSystem or PropertyStore
+// into the status of the failed operation
+func statusError(err error, on errorStatuses) *StatusError {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se
+	}
+
+	status := StatusInternalServerError
+
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		status = StatusServiceUnavailable
+	case err == ErrInvalidCharPath:
+		status = StatusBadRequest
+	case err == ErrNotImplemented:
+		status = StatusNotImplemented
+	case err == ErrExternalEntity:
+		return NewStatusError(StatusForbidden, davName("no-external-entities"))
+
+	case errors.Is(err, fs.ErrNotExist):
+		status = on.notExist
+	case errors.Is(err, fs.ErrExist):
+		status = on.exist
+	case errors.Is(err, fs.ErrPermission):
+		status = StatusForbidden
+	default:
+		if se := errnoStatus(err, on); se != nil {
+			return se
+		}
+	}
+
+	return &StatusError{Status: status}
+}
+
+// status of the failed operation
+func errorStatus(err error, on errorStatuses) int {
+	return statusError(err, on).Status
+}
+
+// error of an unreadable request body
+func bodyError(err error) *StatusError {
+	if err == ErrExternalEntity {
+		return statusError(err, onRead)
+	}
+	return &StatusError{Status: StatusBadRequest}
+}
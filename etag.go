@@ -0,0 +1,141 @@
+package webdav
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// An ETagFunc computes the entity tag of the resource at path,
+// including the surrounding quotes. fi is the result of a Stat of it.
+// http://tools.ietf.org/html/rfc7232#section-2.3
+type ETagFunc func(fs FileSystem, path string, fi os.FileInfo) (string, error)
+
+// ModTimeETag derives a strong entity tag from the modification time and size.
+// It is cheap, but relies on the modification time to change with every write.
+func ModTimeETag(fs FileSystem, path string, fi os.FileInfo) (string, error) {
+	return `"` + strconv.FormatInt(fi.ModTime().UnixNano(), 16) + `-` + strconv.FormatInt(fi.Size(), 16) + `"`, nil
+}
+
+// ContentHashETag derives the entity tag of files from a SHA-256 hash of their
+// content, every file is read completely. Collections use ModTimeETag.
+func ContentHashETag(fs FileSystem, path string, fi os.FileInfo) (string, error) {
+	if fi.IsDir() {
+		return ModTimeETag(fs, path, fi)
+	}
+
+	f, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`, nil
+}
+
+// entity tag of path, empty if it does not exist
+func (s *Server) etag(path string) string {
+	fi, err := s.stat(path)
+	if err != nil {
+		return ""
+	}
+	return s.etagOf(path, fi)
+}
+
+// entity tag of path with known file info, empty on failure
+func (s *Server) etagOf(path string, fi os.FileInfo) string {
+	if fi.IsDir() {
+		return collectionETag(s.ctag(path, fi))
+	}
+
+	fn := s.ETag
+	if fn == nil {
+		fn = ModTimeETag
+	}
+
+	etag, err := fn(s.Fs, path, fi)
+	if err != nil {
+		return ""
+	}
+	return etag
+}
+
+// entity tag of a collection, derived from its change tag
+func collectionETag(ctag string) string {
+	return `"` + ctag + `"`
+}
+
+// split a list of entity tags of an If-Match or If-None-Match header,
+// a "*" is returned as single element
+func parseETags(h string) []string {
+	var ret []string
+
+	for {
+		h = strings.TrimLeft(h, " \t,")
+		if h == "" {
+			return ret
+		}
+
+		if h[0] == '*' {
+			return []string{"*"}
+		}
+
+		// W/"opaque", the opaque part may contain commas
+		i := strings.IndexByte(h, '"')
+		if i < 0 {
+			return ret
+		}
+		j := strings.IndexByte(h[i+1:], '"')
+		if j < 0 {
+			return ret
+		}
+
+		ret = append(ret, h[:i+j+2])
+		h = h[i+j+2:]
+	}
+}
+
+// evaluate If-Match and If-None-Match for the resource at path,
+// returns 0 if the request may proceed, otherwise 412
+// http://tools.ietf.org/html/rfc7232#section-6
+func (s *Server) checkETags(r *http.Request, path string) int {
+	im, inm := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if im == "" && inm == "" {
+		return 0
+	}
+
+	etag := s.etag(path)
+
+	if im != "" {
+		// strong comparison, a weak tag never matches
+		match := false
+		for _, t := range parseETags(im) {
+			if (t == "*" && etag != "") || (etag != "" && t == etag && !strings.HasPrefix(t, "W/")) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return StatusPreconditionFailed
+		}
+	}
+
+	if inm != "" {
+		// weak comparison
+		for _, t := range parseETags(inm) {
+			if (t == "*" && etag != "") || (etag != "" && strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/")) {
+				return StatusPreconditionFailed
+			}
+		}
+	}
+
+	return 0
+}
@@ -1,11 +1,13 @@
 package webdav
 
 import (
+	"context"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // A FileSystem implements access to a collection of named files.
@@ -18,6 +20,39 @@ type FileSystem interface {
 	Remove(name string) error
 }
 
+// A ContextFileSystem is a FileSystem whose operations can be cancelled,
+// e.g. if the client of a request is gone or its deadline is exceeded.
+type ContextFileSystem interface {
+	FileSystem
+
+	OpenContext(ctx context.Context, name string) (File, error)
+	CreateContext(ctx context.Context, name string) (File, error)
+	MkdirContext(ctx context.Context, path string) error
+	RemoveContext(ctx context.Context, name string) error
+}
+
+// A Stater is a FileSystem that can stat files without opening them.
+type Stater interface {
+	Stat(name string) (os.FileInfo, error)
+}
+
+// A Renamer is a FileSystem that can rename files and directories,
+// replacing newname if it is a file.
+type Renamer interface {
+	Rename(oldname, newname string) error
+}
+
+// An OpenFiler is a FileSystem that can open files with
+// os.OpenFile flags and permissions.
+type OpenFiler interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+}
+
+// A Chtimeser is a FileSystem that can change the access and modification times of files.
+type Chtimeser interface {
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
 // A File is returned by a FileSystem's Open and Create method and can
 // be served by the FileServer implementation.
 type File interface {
@@ -101,6 +136,61 @@ func (d Dir) Remove(name string) error {
 	return os.Remove(p)
 }
 
+func (d Dir) Stat(name string) (os.FileInfo, error) {
+	p, err := d.sanitizePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Stat(p)
+}
+
+func (d Dir) Rename(oldname, newname string) error {
+	op, err := d.sanitizePath(oldname)
+	if err != nil {
+		return err
+	}
+	np, err := d.sanitizePath(newname)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(op, np)
+}
+
+func (d Dir) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	p, err := d.sanitizePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d Dir) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := d.sanitizePath(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(p, atime, mtime)
+}
+
+// Quota returns the space used and available to unprivileged users
+// on the disk holding name, only supported on linux.
+func (d Dir) Quota(name string) (used, available int64, err error) {
+	p, err := d.sanitizePath(name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return statfs(p)
+}
+
 // mockup zero content file aka only header
 type emptyFile struct{}
 
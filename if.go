@@ -0,0 +1,240 @@
+package webdav
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parsed If request header, http://www.webdav.org/specs/rfc4918.html#HEADER_If
+type ifHeader struct {
+	lists []ifList
+}
+
+// list of conditions, all of them must match the tagged resource
+// or the Request-URI if the list is untagged
+type ifList struct {
+	resourceTag string
+	conditions  []ifCondition
+}
+
+// state token or entity tag, optionally negated
+type ifCondition struct {
+	not   bool
+	token string
+	etag  string
+}
+
+var errInvalidIf = errors.New("invalid If header")
+
+// parse If header
+//
+//	If = "If" ":" ( 1*No-tag-list | 1*Tagged-list )
+//	Tagged-list = Resource-Tag 1*List
+//	List = "(" 1*Condition ")"
+//	Condition = ["Not"] (State-token | "[" entity-tag "]")
+func parseIfHeader(h string) (ifHeader, error) {
+	var ret ifHeader
+	var tag string
+	var tagged, untagged bool
+
+	h = strings.TrimSpace(h)
+	for len(h) > 0 {
+		switch h[0] {
+		case '<':
+			i := strings.IndexByte(h, '>')
+			if i < 0 || untagged {
+				return ret, errInvalidIf
+			}
+			tag = h[1:i]
+			tagged = true
+			h = strings.TrimSpace(h[i+1:])
+
+			// a resource tag must be followed by at least one list
+			if !strings.HasPrefix(h, "(") {
+				return ret, errInvalidIf
+			}
+		case '(':
+			if !tagged {
+				untagged = true
+			}
+
+			l, rest, err := parseIfList(h[1:])
+			if err != nil {
+				return ret, err
+			}
+			l.resourceTag = tag
+			ret.lists = append(ret.lists, l)
+			h = strings.TrimSpace(rest)
+		default:
+			return ret, errInvalidIf
+		}
+	}
+
+	if len(ret.lists) == 0 {
+		return ret, errInvalidIf
+	}
+
+	return ret, nil
+}
+
+// parse conditions up to and including the closing parenthesis
+func parseIfList(h string) (ifList, string, error) {
+	var l ifList
+
+	for {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			return l, "", errInvalidIf
+		}
+
+		if h[0] == ')' {
+			if len(l.conditions) == 0 {
+				return l, "", errInvalidIf
+			}
+			return l, h[1:], nil
+		}
+
+		var c ifCondition
+		if strings.HasPrefix(h, "Not") {
+			c.not = true
+			h = strings.TrimSpace(h[3:])
+			if h == "" {
+				return l, "", errInvalidIf
+			}
+		}
+
+		switch h[0] {
+		case '<':
+			i := strings.IndexByte(h, '>')
+			if i < 0 {
+				return l, "", errInvalidIf
+			}
+			c.token = h[1:i]
+			h = h[i+1:]
+		case '[':
+			i := strings.IndexByte(h, ']')
+			if i < 0 {
+				return l, "", errInvalidIf
+			}
+			c.etag = h[1:i]
+			h = h[i+1:]
+		default:
+			return l, "", errInvalidIf
+		}
+
+		l.conditions = append(l.conditions, c)
+	}
+}
+
+// all state tokens submitted with the header
+func (h ifHeader) tokens() []string {
+	var ret []string
+
+	for _, l := range h.lists {
+		for _, c := range l.conditions {
+			if c.token != "" && !c.not {
+				ret = append(ret, c.token)
+			}
+		}
+	}
+
+	return ret
+}
+
+// lock tokens submitted with the If header of a request
+func (s *Server) submittedTokens(r *http.Request) []string {
+	h, err := parseIfHeader(r.Header.Get("If"))
+	if err != nil {
+		return nil
+	}
+	return h.tokens()
+}
+
+// evaluate the If, If-Match and If-None-Match headers of the request and test
+// the resources at lockPaths for locks whose token was not submitted. Returns nil
+// if the request may proceed, otherwise the error to fail with.
+// http://www.webdav.org/specs/rfc4918.html#if.header.evaluation
+func (s *Server) checkConditions(r *http.Request, lockPaths ...string) *StatusError {
+	var h ifHeader
+
+	if v := r.Header.Get("If"); v != "" {
+		var err error
+		if h, err = parseIfHeader(v); err != nil {
+			return &StatusError{Status: StatusBadRequest}
+		}
+
+		if !s.evalIf(h, s.url2path(r.URL)) {
+			return &StatusError{Status: StatusPreconditionFailed}
+		}
+	}
+
+	if status := s.checkETags(r, s.url2path(r.URL)); status != 0 {
+		return &StatusError{Status: status}
+	}
+
+	tokens := h.tokens()
+	for _, p := range lockPaths {
+		if s.isLocked(p, tokens) {
+			return s.lockError(p)
+		}
+	}
+
+	return nil
+}
+
+// does at least one list match its resource?
+func (s *Server) evalIf(h ifHeader, requestPath string) bool {
+	for _, l := range h.lists {
+		p := requestPath
+		if l.resourceTag != "" {
+			u, err := url.Parse(l.resourceTag)
+			if err != nil || !s.inNamespace(u) {
+				continue
+			}
+			p = s.url2path(u)
+		}
+
+		if s.evalIfList(l, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// do all conditions of the list match the resource at path?
+func (s *Server) evalIfList(l ifList, path string) bool {
+	var locks []*Lock
+	var etag string
+
+	for _, c := range l.conditions {
+		var match bool
+
+		if c.token != "" {
+			if locks == nil {
+				locks = s.Locks.Locks(path)
+			}
+
+			for _, lock := range locks {
+				if lock.Token == c.token {
+					match = true
+					break
+				}
+			}
+		} else {
+			if etag == "" {
+				etag = s.etag(path)
+			}
+
+			match = etag != "" && strings.TrimPrefix(etag, "W/") == strings.TrimPrefix(c.etag, "W/")
+		}
+
+		if match == c.not {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,137 @@
+package webdav
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIfHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []ifList
+		ok     bool
+	}{
+		{"(<urn:a>)", []ifList{{"", []ifCondition{{token: "urn:a"}}}}, true},
+		{"  ( <urn:a> ) ", []ifList{{"", []ifCondition{{token: "urn:a"}}}}, true},
+		{`(["abc"])`, []ifList{{"", []ifCondition{{etag: `"abc"`}}}}, true},
+		{`(Not <urn:a> [W/"abc"])`, []ifList{{"", []ifCondition{{not: true, token: "urn:a"}, {etag: `W/"abc"`}}}}, true},
+		{"(<urn:a>) (Not <DAV:no-lock>)", []ifList{
+			{"", []ifCondition{{token: "urn:a"}}},
+			{"", []ifCondition{{not: true, token: "DAV:no-lock"}}},
+		}, true},
+		{"</a> (<urn:a>) (<urn:b>) </b> (<urn:c>)", []ifList{
+			{"/a", []ifCondition{{token: "urn:a"}}},
+			{"/a", []ifCondition{{token: "urn:b"}}},
+			{"/b", []ifCondition{{token: "urn:c"}}},
+		}, true},
+		{"<http://example.com/a%20b> ([\"x\"])", []ifList{{"http://example.com/a%20b", []ifCondition{{etag: `"x"`}}}}, true},
+
+		{"", nil, false},
+		{"()", nil, false},
+		{"(<urn:a>", nil, false},
+		{"(<urn:a)", nil, false},
+		{`(["abc")`, nil, false},
+		{"(Not)", nil, false},
+		{"(urn:a)", nil, false},
+		{"</a>", nil, false},
+		{"</a> </b> (<urn:a>)", nil, false},
+		{"(<urn:a>) </a> (<urn:b>)", nil, false},
+		{"<urn:a>)", nil, false},
+	}
+
+	for _, tt := range tests {
+		h, err := parseIfHeader(tt.header)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseIfHeader(%q) error %v, want ok %v", tt.header, err, tt.ok)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(h.lists, tt.want) {
+			t.Errorf("parseIfHeader(%q) = %+v, want %+v", tt.header, h.lists, tt.want)
+		}
+	}
+}
+
+func TestIfTokens(t *testing.T) {
+	h, err := parseIfHeader(`</a> (<urn:a> ["x"]) (Not <urn:b>) </b> (<urn:c>)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"urn:a", "urn:c"}
+	if got := h.tokens(); !reflect.DeepEqual(got, want) {
+		t.Errorf("tokens() = %q, want %q", got, want)
+	}
+}
+
+func TestEvalIf(t *testing.T) {
+	fs := Dir(t.TempDir())
+	if err := os.WriteFile(string(fs)+"/a", []byte("a"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(string(fs)+"/b", []byte("b"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Fs:         fs,
+		TrimPrefix: "/webdav/",
+		Locks:      NewLockManager(),
+		ETag: func(fs FileSystem, path string, fi os.FileInfo) (string, error) {
+			return `"` + strings.TrimPrefix(path, "/") + `"`, nil
+		},
+	}
+
+	lock, err := s.Locks.Lock("/a", 0, true, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := lock.Token
+
+	tests := []struct {
+		header string
+		path   string
+		want   bool
+	}{
+		{"(<" + token + ">)", "/a", true},
+		{"(<" + token + ">)", "/b", false},
+		{"(<urn:other>)", "/a", false},
+		{"(Not <" + token + ">)", "/a", false},
+		{"(Not <urn:other>)", "/a", true},
+		{"(<DAV:no-lock>)", "/a", false},
+		{"(Not <DAV:no-lock>)", "/a", true},
+		{`(["a"])`, "/a", true},
+		{`([W/"a"])`, "/a", true},
+		{`(["b"])`, "/a", false},
+		{`(Not ["b"])`, "/a", true},
+		{`(["a"])`, "/missing", false},
+		{`(Not ["a"])`, "/missing", true},
+		{"(<" + token + `> ["a"])`, "/a", true},
+		{"(<" + token + `> ["b"])`, "/a", false},
+		{`(["b"]) (<` + token + ">)", "/a", true},
+		{"(<urn:other>) (Not <DAV:no-lock>)", "/b", true},
+
+		// tagged lists apply to their resource, whatever the request uri is
+		{"</webdav/a> (<" + token + ">)", "/b", true},
+		{"<http://example.com/webdav/a> (<" + token + ">)", "/b", true},
+		{`</webdav/b> (["b"])`, "/a", true},
+		{`</webdav/b> (["a"])`, "/a", false},
+		{"</webdav/b> (<" + token + ">)", "/a", false},
+		{"</other/a> (<" + token + ">)", "/a", false},
+		{`</webdav/b> (["a"]) </webdav/a> (["a"])`, "/b", true},
+	}
+
+	for _, tt := range tests {
+		h, err := parseIfHeader(tt.header)
+		if err != nil {
+			t.Errorf("parseIfHeader(%q): %v", tt.header, err)
+			continue
+		}
+
+		if got := s.evalIf(h, tt.path); got != tt.want {
+			t.Errorf("evalIf(%q, %q) = %v, want %v", tt.header, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package webdav
+
+import (
+	"crypto/rand"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// infinite lock depth and timeout
+const (
+	InfiniteDepth   = -1
+	InfiniteTimeout = time.Duration(-1)
+)
+
+// A Lock is a write lock on a resource, http://www.webdav.org/specs/rfc4918.html#write.lock
+type Lock struct {
+	// opaquelocktoken uri identifying the lock
+	Token string
+
+	// path of the locked resource
+	Root string
+
+	// 0 or InfiniteDepth
+	Depth int
+
+	// exclusive or shared lock
+	Exclusive bool
+
+	// xml content of the owner element as supplied by the client
+	Owner string
+
+	// requested duration of the lock, InfiniteTimeout if it never expires
+	Timeout time.Duration
+
+	expires time.Time
+}
+
+// does the lock apply to path?
+func (l *Lock) covers(p string) bool {
+	return l.Root == p || (l.Depth == InfiniteDepth && isDescendant(l.Root, p))
+}
+
+func (l *Lock) expired(now time.Time) bool {
+	return l.Timeout != InfiniteTimeout && now.After(l.expires)
+}
+
+func (l *Lock) refresh(timeout time.Duration) {
+	l.Timeout = timeout
+	if timeout != InfiniteTimeout {
+		l.expires = time.Now().Add(timeout)
+	}
+}
+
+// remaining duration of the lock, formatted for the Timeout header and timeout element
+func (l *Lock) timeoutString() string {
+	if l.Timeout == InfiniteTimeout {
+		return "Infinite"
+	}
+
+	s := int64((time.Until(l.expires) + time.Second - 1) / time.Second)
+	if s < 0 {
+		s = 0
+	}
+	return "Second-" + strconv.FormatInt(s, 10)
+}
+
+// A LockManager keeps track of the write locks held on the resources of a Server.
+// Locks are held in memory only and do not survive a restart.
+type LockManager struct {
+	// upper limit for the lock timeout, zero means locks may be infinite
+	MaxTimeout time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*Lock
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{locks: map[string]*Lock{}}
+}
+
+// remove expired locks, mu must be held
+func (m *LockManager) expire() {
+	now := time.Now()
+	for t, l := range m.locks {
+		if l.expired(now) {
+			delete(m.locks, t)
+		}
+	}
+}
+
+func (m *LockManager) timeout(t time.Duration) time.Duration {
+	if m.MaxTimeout > 0 && (t == InfiniteTimeout || t > m.MaxTimeout) {
+		return m.MaxTimeout
+	}
+	return t
+}
+
+// Lock creates a new lock on the resource at path. ErrLocked is returned if
+// the lock conflicts with an existing one.
+func (m *LockManager) Lock(p string, depth int, exclusive bool, owner string, timeout time.Duration) (*Lock, error) {
+	p = cleanPath(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	for _, l := range m.locks {
+		if !l.Exclusive && !exclusive {
+			continue
+		}
+
+		// existing lock on path or ancestor, or a new infinite lock on an ancestor of a locked resource
+		if l.covers(p) || (depth == InfiniteDepth && isDescendant(p, l.Root)) {
+			return nil, ErrLocked
+		}
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Lock{
+		Token:     token,
+		Root:      p,
+		Depth:     depth,
+		Exclusive: exclusive,
+		Owner:     owner,
+	}
+	l.refresh(m.timeout(timeout))
+	m.locks[token] = l
+
+	c := *l
+	return &c, nil
+}
+
+// Refresh resets the timeout of the first lock in tokens that applies to
+// the resource at path. ErrNoSuchLock is returned if there is none.
+func (m *LockManager) Refresh(p string, tokens []string, timeout time.Duration) (*Lock, error) {
+	p = cleanPath(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	for _, t := range tokens {
+		if l, ok := m.locks[t]; ok && l.covers(p) {
+			l.refresh(m.timeout(timeout))
+
+			c := *l
+			return &c, nil
+		}
+	}
+
+	return nil, ErrNoSuchLock
+}
+
+// Unlock removes the lock identified by token, which must apply to the
+// resource at path. ErrNoSuchLock is returned otherwise.
+func (m *LockManager) Unlock(p, token string) error {
+	p = cleanPath(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	l, ok := m.locks[token]
+	if !ok || !l.covers(p) {
+		return ErrNoSuchLock
+	}
+
+	delete(m.locks, token)
+	return nil
+}
+
+// Locks returns all active locks that apply to the resource at path,
+// either directly or through an infinite lock on one of its ancestors.
+func (m *LockManager) Locks(p string) []*Lock {
+	p = cleanPath(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	var ret []*Lock
+	for _, l := range m.locks {
+		if l.covers(p) {
+			c := *l
+			ret = append(ret, &c)
+		}
+	}
+
+	return ret
+}
+
+// Below returns all active locks rooted at members of the collection at path.
+func (m *LockManager) Below(p string) []*Lock {
+	p = cleanPath(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	var ret []*Lock
+	for _, l := range m.locks {
+		if isDescendant(p, l.Root) {
+			c := *l
+			ret = append(ret, &c)
+		}
+	}
+
+	return ret
+}
+
+// Remove drops all locks on the resource at path and its members,
+// e.g. after the resource was deleted.
+func (m *LockManager) Remove(p string) {
+	p = cleanPath(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for t, l := range m.locks {
+		if l.Root == p || isDescendant(p, l.Root) {
+			delete(m.locks, t)
+		}
+	}
+}
+
+// generate a new opaquelocktoken uri, http://www.webdav.org/specs/rfc4918.html#opaquelocktoken.lock.token.uri.scheme
+func newLockToken() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+
+	// random uuid, rfc 4122 version 4
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+// parse the Timeout request header, http://www.webdav.org/specs/rfc4918.html#HEADER_Timeout
+// the first understood value is used, defaults to InfiniteTimeout
+func parseTimeout(h string) time.Duration {
+	for _, v := range strings.Split(h, ",") {
+		v = strings.TrimSpace(v)
+
+		if v == "Infinite" {
+			return InfiniteTimeout
+		}
+
+		if s := strings.TrimPrefix(v, "Second-"); len(s) < len(v) {
+			n, err := strconv.ParseUint(s, 10, 32)
+			if err == nil {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+
+	return InfiniteTimeout
+}
+
+// normalize path for comparison
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// is child a member of the collection parent, at any depth?
+func isDescendant(parent, child string) bool {
+	if parent == "/" {
+		return child != "/"
+	}
+	return strings.HasPrefix(child, parent+"/")
+}
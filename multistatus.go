@@ -0,0 +1,82 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+)
+
+// A MultiStatusWriter streams a 207 Multi-Status response, every response
+// element is encoded and sent as soon as it is written.
+// http://www.webdav.org/specs/rfc4918.html#ELEMENT_multistatus
+type MultiStatusWriter struct {
+	// optional responsedescription of the whole multistatus, written by Close
+	ResponseDescription string
+
+	// sync-token of a sync-collection report, written by Close
+	// http://tools.ietf.org/html/rfc6578#section-6.4
+	SyncToken string
+
+	w       http.ResponseWriter
+	enc     *xml.Encoder
+	started bool
+}
+
+func NewMultiStatusWriter(w http.ResponseWriter) *MultiStatusWriter {
+	return &MultiStatusWriter{w: w}
+}
+
+// send headers and the start of the multistatus element
+func (m *MultiStatusWriter) start() error {
+	if m.started {
+		return nil
+	}
+	m.started = true
+
+	m.w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	m.w.WriteHeader(StatusMulti)
+
+	if _, err := io.WriteString(m.w, xml.Header); err != nil {
+		return err
+	}
+
+	m.enc = xml.NewEncoder(m.w)
+	return m.enc.EncodeToken(xml.StartElement{Name: davName("multistatus")})
+}
+
+// Write sends a single response element.
+func (m *MultiStatusWriter) Write(r Response) error {
+	if err := m.start(); err != nil {
+		return err
+	}
+
+	if err := m.enc.Encode(r); err != nil {
+		return err
+	}
+	return m.enc.Flush()
+}
+
+// Close finishes the multistatus element. A multistatus without
+// any response is sent if nothing has been written yet.
+func (m *MultiStatusWriter) Close() error {
+	if err := m.start(); err != nil {
+		return err
+	}
+
+	if m.ResponseDescription != "" {
+		if err := m.enc.EncodeElement(m.ResponseDescription, xml.StartElement{Name: davName("responsedescription")}); err != nil {
+			return err
+		}
+	}
+
+	if m.SyncToken != "" {
+		if err := m.enc.EncodeElement(m.SyncToken, xml.StartElement{Name: davName("sync-token")}); err != nil {
+			return err
+		}
+	}
+
+	if err := m.enc.EncodeToken(xml.EndElement{Name: davName("multistatus")}); err != nil {
+		return err
+	}
+	return m.enc.Flush()
+}
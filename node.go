@@ -1,79 +1,174 @@
 package webdav
 
 import (
+	"bytes"
 	"encoding/xml"
 	"io"
+	"sort"
+	"strconv"
 )
 
+type NodeType int
+
+// node types
+const (
+	ElementNode NodeType = iota
+	TextNode
+	CommentNode
+)
+
+// namespace of the predefined xml prefix
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
 type Node struct {
-	Name     xml.Name
-	Attr     []xml.Attr
+	Type NodeType
+
+	// name and attributes of element nodes, without namespace declarations
+	Name xml.Name
+	Attr []xml.Attr
+
+	// character data of text and comment nodes
+	Data string
+
+	// value of xml:lang in scope
+	Lang string
+
+	// namespace declarations in scope, prefix to namespace,
+	// the empty prefix is the default namespace
+	Namespaces map[string]string
+
+	// child nodes in document order, including text and comments
 	Children []*Node
 	Parent   *Node
 }
 
+// parse a complete xml document, io.EOF is returned if it contains no element
 func NodeFromXml(r io.Reader) (*Node, error) {
-	var cur, parent *Node
-
-	decoder := xml.NewDecoder(r)
+	decoder := newXmlDecoder(r)
 	for {
 		token, err := decoder.Token()
 		if err != nil {
-			if err != io.EOF {
-				return nil, err
-			}
-			break
+			return nil, err
 		}
 
-		switch tok := token.(type) {
-		case xml.StartElement:
-			parent = cur
+		if tok, ok := token.(xml.StartElement); ok {
+			return readNode(decoder, tok, nil)
+		}
+	}
+}
 
-			// if tok.Name.Space != "DAV:" {
-			if tok.Name.Space == "" {
+// read the element start and its content up to the matching end element
+func readNode(d *xml.Decoder, start xml.StartElement, parent *Node) (*Node, error) {
+	n := &Node{
+		Type:       ElementNode,
+		Name:       start.Name,
+		Parent:     parent,
+		Namespaces: map[string]string{},
+	}
+
+	if parent != nil {
+		n.Lang = parent.Lang
+		n.Namespaces = parent.Namespaces
+	}
+
+	copied := false
+	for _, a := range start.Attr {
+		switch {
+		case a.Name.Space == "xmlns":
+			// prefixes can not be undeclared, http://www.w3.org/TR/xml-names/#nsc-NoPrefixUndecl
+			if a.Value == "" {
 				return nil, ErrMalformedXml
 			}
+			fallthrough
+		case a.Name.Space == "" && a.Name.Local == "xmlns":
+			if !copied {
+				ns := map[string]string{}
+				for k, v := range n.Namespaces {
+					ns[k] = v
+				}
+				n.Namespaces = ns
+				copied = true
+			}
 
-			cur = &Node{
-				Name:   tok.Name,
-				Attr:   tok.Attr,
-				Parent: parent,
+			if a.Name.Space == "xmlns" {
+				n.Namespaces[a.Name.Local] = a.Value
+			} else {
+				n.Namespaces[""] = a.Value
 			}
+		default:
+			if a.Name.Space == xmlNamespace && a.Name.Local == "lang" {
+				n.Lang = a.Value
+			}
+			n.Attr = append(n.Attr, a)
+		}
+	}
 
-			if parent != nil {
-				parent.Children = append(parent.Children, cur)
+	for {
+		token, err := d.Token()
+		if err != nil {
+			if err == io.EOF {
+				err = ErrMalformedXml
+			}
+			return nil, err
+		}
+
+		switch tok := token.(type) {
+		case xml.StartElement:
+			c, err := readNode(d, tok, n)
+			if err != nil {
+				return nil, err
 			}
+			n.Children = append(n.Children, c)
 		case xml.EndElement:
-			if cur.Parent == nil {
-				return cur, nil
+			return n, nil
+		case xml.CharData:
+			// merge adjacent text, e.g. cdata sections
+			if l := len(n.Children); l > 0 && n.Children[l-1].Type == TextNode {
+				n.Children[l-1].Data += string(tok)
+				continue
 			}
-			cur = cur.Parent
-		default:
-			//log.Printf("%T", tok)
+			n.Children = append(n.Children, n.child(TextNode, string(tok)))
+		case xml.Comment:
+			n.Children = append(n.Children, n.child(CommentNode, string(tok)))
 		}
 	}
+}
+
+// new text or comment node inside n
+func (n *Node) child(t NodeType, data string) *Node {
+	return &Node{
+		Type:       t,
+		Data:       data,
+		Lang:       n.Lang,
+		Namespaces: n.Namespaces,
+		Parent:     n,
+	}
+}
 
-	return cur, nil
+// name in the DAV: namespace
+func davName(local string) xml.Name {
+	return xml.Name{Space: "DAV:", Local: local}
 }
 
-func (n Node) HasChildren(name string) bool {
+// does the node match name? A local name of "*" matches any element.
+func (n *Node) is(name xml.Name) bool {
+	return n.Type == ElementNode && (name.Local == "*" || n.Name == name)
+}
+
+func (n Node) HasChildren(name xml.Name) bool {
 	for _, v := range n.Children {
-		if v.Name.Local == name {
+		if v.is(name) {
 			return true
 		}
 	}
 	return false
 }
 
-func (n *Node) GetChildrens(name string) []*Node {
-	if name == "*" {
-		return n.Children
-	}
-
+func (n *Node) GetChildrens(name xml.Name) []*Node {
 	var ret []*Node
 
 	for _, v := range n.Children {
-		if v.Name.Local == name {
+		if v.is(name) {
 			ret = append(ret, v)
 		}
 	}
@@ -81,13 +176,9 @@ func (n *Node) GetChildrens(name string) []*Node {
 	return ret
 }
 
-func (n *Node) FirstChildren(name string) *Node {
-	if name == "*" && len(n.Children) > 0 {
-		return n.Children[0]
-	}
-
+func (n *Node) FirstChildren(name xml.Name) *Node {
 	for _, v := range n.Children {
-		if v.Name.Local == name {
+		if v.is(name) {
 			return v
 		}
 	}
@@ -95,14 +186,152 @@ func (n *Node) FirstChildren(name string) *Node {
 	return nil
 }
 
+// concatenated character data of the node and its descendants
+func (n *Node) Text() string {
+	if n.Type != ElementNode {
+		return n.Data
+	}
+
+	var r string
+	for _, v := range n.Children {
+		if v.Type != CommentNode {
+			r += v.Text()
+		}
+	}
+	return r
+}
+
+// String returns the node serialized as xml. Namespaces in scope of the node
+// are declared on it, so the result is a self-contained fragment.
 func (n *Node) String() string {
-	r := "<" + n.Name.Local + " xmlns=\"" + n.Name.Space + "\">\n"
+	buf := new(bytes.Buffer)
+	n.write(buf, nil)
+	return buf.String()
+}
 
+// InnerXML returns the serialized content of the node, every top level
+// element declares the namespaces in scope.
+func (n *Node) InnerXML() string {
+	buf := new(bytes.Buffer)
 	for _, v := range n.Children {
-		r += v.String() + "\n"
+		v.write(buf, nil)
+	}
+	return buf.String()
+}
+
+// serialize the node, declared are the namespaces declared by already written ancestors
+func (n *Node) write(buf *bytes.Buffer, declared map[string]string) {
+	switch n.Type {
+	case TextNode:
+		xml.EscapeText(buf, []byte(n.Data))
+		return
+	case CommentNode:
+		buf.WriteString(`<!--` + n.Data + `-->`)
+		return
+	}
+
+	// declare namespaces that are not yet in scope of the output,
+	// the default namespace of the surrounding output is unknown at the top
+	scope := map[string]string{"": "\x00"}
+	if declared != nil {
+		scope = map[string]string{}
+	}
+	for k, v := range declared {
+		scope[k] = v
 	}
 
-	r += "<\\" + n.Name.Local + ">"
+	prefixes := make([]string, 0, len(n.Namespaces))
+	for p := range n.Namespaces {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
 
-	return r
+	decl := new(bytes.Buffer)
+	for _, p := range prefixes {
+		uri := n.Namespaces[p]
+		if scope[p] == uri {
+			continue
+		}
+		scope[p] = uri
+		writeXmlns(decl, p, uri)
+	}
+
+	if n.Name.Space == "" && scope[""] != "" {
+		decl.WriteString(` xmlns=""`)
+		scope[""] = ""
+	}
+
+	name := qualify(scope, decl, n.Name, false)
+	attrs := new(bytes.Buffer)
+	for _, a := range n.Attr {
+		attrs.WriteString(` ` + qualify(scope, decl, a.Name, true) + `="`)
+		xml.EscapeText(attrs, []byte(a.Value))
+		attrs.WriteString(`"`)
+	}
+
+	buf.WriteString(`<` + name)
+	decl.WriteTo(buf)
+	attrs.WriteTo(buf)
+
+	if len(n.Children) == 0 {
+		buf.WriteString(`/>`)
+		return
+	}
+
+	buf.WriteString(`>`)
+	for _, v := range n.Children {
+		v.write(buf, scope)
+	}
+	buf.WriteString(`</` + name + `>`)
+}
+
+// write a namespace declaration, p is empty for the default namespace
+func writeXmlns(buf *bytes.Buffer, p, uri string) {
+	if p == "" {
+		buf.WriteString(` xmlns="`)
+	} else {
+		buf.WriteString(` xmlns:` + p + `="`)
+	}
+	xml.EscapeText(buf, []byte(uri))
+	buf.WriteString(`"`)
+}
+
+// prefixed name using the namespace declarations in scope, attributes are never
+// in the default namespace. Namespaces that are not in scope, e.g. declared
+// outside of a parsed fragment, are declared to decl.
+func qualify(scope map[string]string, decl *bytes.Buffer, name xml.Name, attr bool) string {
+	switch {
+	case name.Space == "":
+		return name.Local
+	case name.Space == xmlNamespace:
+		return "xml:" + name.Local
+	case !attr && scope[""] == name.Space:
+		return name.Local
+	}
+
+	var prefixes []string
+	for p, uri := range scope {
+		if p != "" && uri == name.Space {
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	if len(prefixes) > 0 {
+		sort.Strings(prefixes)
+		return prefixes[0] + ":" + name.Local
+	}
+
+	if !attr {
+		scope[""] = name.Space
+		writeXmlns(decl, "", name.Space)
+		return name.Local
+	}
+
+	p := "ns"
+	for i := 0; scope[p] != ""; i++ {
+		p = "ns" + strconv.Itoa(i)
+	}
+	scope[p] = name.Space
+	writeXmlns(decl, p, name.Space)
+	return p + ":" + name.Local
 }
@@ -0,0 +1,162 @@
+package webdav
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var roundTripDocuments = []string{
+	`<a/>`,
+	`<D:prop xmlns:D="DAV:"><D:getetag/></D:prop>`,
+	`<prop xmlns="DAV:"><displayname>x</displayname></prop>`,
+	`<D:prop xmlns:D="DAV:" xmlns:Z="http://example.com/ns"><Z:author><Z:name>Jim</Z:name></Z:author></D:prop>`,
+	`<D:prop xmlns:D="DAV:"><x:a xmlns:x="urn:x" x:attr="1" plain="2"/></D:prop>`,
+	`<D:prop xmlns:D="DAV:"><a xmlns="">no namespace</a></D:prop>`,
+	`<prop xmlns="DAV:"><a xmlns="urn:a"><b xmlns="urn:b"><c xmlns="">text</c></b></a></prop>`,
+	`<prop xmlns="DAV:" xml:lang="en"><title xml:lang="de">Titel</title><note>mixed <b>bold</b> text</note></prop>`,
+	`<prop xmlns="DAV:"><a>&lt;escaped&gt; &amp; "quoted"</a><!-- comment --><b><![CDATA[<cdata>]]> and more</b></prop>`,
+	`<prop xmlns="DAV:"><a xmlns:p="urn:p" xmlns:q="urn:p"><p:x q:y="1"/></a></prop>`,
+	`<p:prop xmlns:p="DAV:"><p:a xmlns:p="urn:other"><p:b/></p:a></p:prop>`,
+	`<prop xmlns="DAV:"><ümläut attr="日本語">😀</ümläut></prop>`,
+}
+
+// node tree without parents and namespace declarations, to compare documents
+type plainNode struct {
+	Type     NodeType
+	Name     string
+	Attr     []string
+	Data     string
+	Lang     string
+	Children []plainNode
+}
+
+func plain(n *Node) plainNode {
+	p := plainNode{
+		Type: n.Type,
+		Name: n.Name.Space + " " + n.Name.Local,
+		Data: n.Data,
+		Lang: n.Lang,
+	}
+	for _, a := range n.Attr {
+		p.Attr = append(p.Attr, a.Name.Space+" "+a.Name.Local+"="+a.Value)
+	}
+	for _, c := range n.Children {
+		p.Children = append(p.Children, plain(c))
+	}
+	return p
+}
+
+func TestNodeRoundTrip(t *testing.T) {
+	for _, doc := range roundTripDocuments {
+		n, err := NodeFromXml(strings.NewReader(doc))
+		if err != nil {
+			t.Errorf("parsing %q: %v", doc, err)
+			continue
+		}
+
+		s := n.String()
+		m, err := NodeFromXml(strings.NewReader(s))
+		if err != nil {
+			t.Errorf("parsing %q serialized from %q: %v", s, doc, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(plain(n), plain(m)) {
+			t.Errorf("%q serialized as %q:\n%+v\nwant\n%+v", doc, s, plain(m), plain(n))
+		}
+
+		// every member is a self-contained fragment, like dead properties are stored
+		for i, c := range n.Children {
+			if c.Type != ElementNode {
+				continue
+			}
+
+			s := c.String()
+			m, err := NodeFromXml(strings.NewReader(s))
+			if err != nil {
+				t.Errorf("parsing %q serialized from member %d of %q: %v", s, i, doc, err)
+				continue
+			}
+
+			// xml:lang is inherited and not declared on the fragment
+			want := plain(c)
+			got := plain(m)
+			clearLang(&want)
+			clearLang(&got)
+			if !reflect.DeepEqual(want, got) {
+				t.Errorf("member %d of %q serialized as %q:\n%+v\nwant\n%+v", i, doc, s, got, want)
+			}
+		}
+	}
+}
+
+func clearLang(p *plainNode) {
+	p.Lang = ""
+	for i := range p.Children {
+		clearLang(&p.Children[i])
+	}
+}
+
+func TestNodeString(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`<a/>`, `<a xmlns=""/>`},
+		{`<D:prop xmlns:D="DAV:"><D:getetag></D:getetag></D:prop>`, `<D:prop xmlns:D="DAV:"><D:getetag/></D:prop>`},
+		{`<prop xmlns="DAV:"><a>x &lt; y</a></prop>`, `<prop xmlns="DAV:"><a>x &lt; y</a></prop>`},
+		{`<prop xmlns="DAV:"><a xmlns="">x</a></prop>`, `<prop xmlns="DAV:"><a xmlns="">x</a></prop>`},
+		{`<prop xmlns="DAV:" xmlns:z="urn:z"><z:a z:b="c"/></prop>`, `<prop xmlns="DAV:" xmlns:z="urn:z"><z:a z:b="c"/></prop>`},
+		{`<prop xmlns="DAV:" xml:lang="en"/>`, `<prop xmlns="DAV:" xml:lang="en"/>`},
+	}
+
+	for _, tt := range tests {
+		n, err := NodeFromXml(strings.NewReader(tt.doc))
+		if err != nil {
+			t.Errorf("parsing %q: %v", tt.doc, err)
+			continue
+		}
+
+		if got := n.String(); got != tt.want {
+			t.Errorf("%q serialized as %q, want %q", tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestNodeMemberString(t *testing.T) {
+	doc := `<D:prop xmlns:D="DAV:" xmlns:Z="urn:z"><Z:author><Z:name>Jim</Z:name></Z:author><D:x/></D:prop>`
+	n, err := NodeFromXml(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// namespaces declared by ancestors are declared on the fragment
+	want := []string{
+		`<Z:author xmlns:D="DAV:" xmlns:Z="urn:z"><Z:name>Jim</Z:name></Z:author>`,
+		`<D:x xmlns:D="DAV:" xmlns:Z="urn:z"/>`,
+	}
+	for i, c := range n.Children {
+		if got := c.String(); got != want[i] {
+			t.Errorf("member %d serialized as %q, want %q", i, got, want[i])
+		}
+	}
+
+	if got, want := n.InnerXML(), strings.Join(want, ""); got != want {
+		t.Errorf("InnerXML() = %q, want %q", got, want)
+	}
+}
+
+func TestNodeFromXmlErrors(t *testing.T) {
+	for _, doc := range []string{
+		``,
+		`<!-- only a comment -->`,
+		`<a>`,
+		`<a></b>`,
+		`<a xmlns:p=""/>`,
+	} {
+		if _, err := NodeFromXml(strings.NewReader(doc)); err == nil {
+			t.Errorf("parsing %q succeeded", doc)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// content type of PATCH bodies with a byte range update of the resource,
+// the range is given by the X-Update-Range header. http://sabre.io/dav/http-patch/
+const partialUpdateType = "application/x-sabredav-partialupdate"
+
+var (
+	errInvalidRange        = errors.New("invalid range")
+	errRangeNotSatisfiable = errors.New("range not satisfiable")
+)
+
+// parse the Content-Range header of a partial PUT, returns the offset and length of the range
+// http://tools.ietf.org/html/rfc7233#section-4.2
+//
+//	Content-Range = "bytes" SP first-byte-pos "-" last-byte-pos "/" ( complete-length / "*" )
+func parseContentRange(h string) (offset, length int64, err error) {
+	if !strings.HasPrefix(h, "bytes ") {
+		return 0, 0, errInvalidRange
+	}
+
+	rng, complete, ok := strings.Cut(strings.TrimSpace(h[6:]), "/")
+	if !ok {
+		return 0, 0, errInvalidRange
+	}
+
+	f, l, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, errInvalidRange
+	}
+
+	first, err := strconv.ParseInt(f, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, errInvalidRange
+	}
+	last, err := strconv.ParseInt(l, 10, 64)
+	if err != nil || last < first {
+		return 0, 0, errInvalidRange
+	}
+
+	if complete != "*" {
+		c, err := strconv.ParseInt(complete, 10, 64)
+		if err != nil || last >= c {
+			return 0, 0, errInvalidRange
+		}
+	}
+
+	return first, last - first + 1, nil
+}
+
+// parse the X-Update-Range header of PATCH for a resource of size bytes,
+// returns the offset of the update and its length, or -1 if it is open.
+// The update of "bytes=-" starts the given number of bytes before the end.
+//
+//	X-Update-Range = "append" | "bytes=" start "-" end | "bytes=" start "-" | "bytes=-" offset-from-end
+func parseUpdateRange(h string, size int64) (offset, length int64, err error) {
+	if h == "append" {
+		return size, -1, nil
+	}
+
+	if !strings.HasPrefix(h, "bytes=") {
+		return 0, 0, errInvalidRange
+	}
+
+	s, e, ok := strings.Cut(h[6:], "-")
+	if !ok || (s == "" && e == "") {
+		return 0, 0, errInvalidRange
+	}
+
+	// from the end of the resource, the body may extend it
+	if s == "" {
+		n, err := strconv.ParseInt(e, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errInvalidRange
+		}
+		if n > size {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		return size - n, -1, nil
+	}
+
+	start, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errInvalidRange
+	}
+	if start > size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+
+	if e == "" {
+		return start, -1, nil
+	}
+
+	end, err := strconv.ParseInt(e, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, errInvalidRange
+	}
+	return start, end - start + 1, nil
+}
+
+// write length bytes of body at offset into the file at path, which is
+// created if it does not exist. Only possible if the FileSystem is an OpenFiler.
+func (s *Server) writeRange(ctx context.Context, path string, offset, length int64, body io.Reader) error {
+	if _, ok := s.Fs.(OpenFiler); !ok {
+		return ErrNotImplemented
+	}
+
+	f, err := s.openFile(ctx, path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := io.CopyN(f, contextReader{ctx, body}, length); err != nil {
+		f.Close()
+		if err == io.EOF {
+			// body is shorter than the range
+			return &StatusError{Status: StatusBadRequest}
+		}
+		return err
+	}
+
+	return f.Close()
+}
+
+// update length bytes at offset of the resource at path with the request body,
+// the status to fail with is returned
+func (s *Server) updateRange(r *http.Request, path string, offset, length int64) *StatusError {
+	// the digests would have to be verified before the resource is changed
+	if digests, err := newDigester(r.Header); err != nil {
+		return &StatusError{Status: StatusBadRequest}
+	} else if digests.verifying() {
+		return &StatusError{Status: StatusNotImplemented}
+	}
+
+	var size int64
+	if fi, err := s.stat(path); err == nil {
+		size = fi.Size()
+	}
+
+	grown := offset + length - size
+	if grown < 0 {
+		grown = 0
+	}
+	if !s.quotaAllows(grown) {
+		return NewStatusError(StatusInsufficientStorage, davName("quota-not-exceeded"))
+	}
+
+	err := s.writeRange(r.Context(), path, offset, length, r.Body)
+
+	// the file may be changed even if writing failed
+	s.modified(path)
+	s.forgetChecksums(path)
+	if err != nil {
+		return statusError(err, onCreate)
+	}
+
+	s.grew(grown)
+	return nil
+}
+
+// PUT with Content-Range, the range of the resource is replaced by the request body
+// http://tools.ietf.org/html/rfc7231#section-4.3.4
+func (s *Server) putRange(w http.ResponseWriter, r *http.Request, path string) {
+	// the body has to be as long as the range, otherwise bytes
+	// beyond it would be dropped without notice
+	if r.ContentLength < 0 {
+		w.WriteHeader(StatusLengthRequired)
+		return
+	}
+
+	offset, length, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil || r.ContentLength != length {
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	// a server that can not apply the range must not replace the whole resource
+	if _, ok := s.Fs.(OpenFiler); !ok {
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	exists := s.pathExists(path)
+	if err := s.updateRange(r, path, offset, length); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if etag := s.etag(path); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if exists {
+		w.WriteHeader(StatusNoContent)
+	} else {
+		w.WriteHeader(StatusCreated)
+	}
+}
+
+// The PATCH method updates a byte range of a file or appends to it
+// http://sabre.io/dav/http-patch/
+func (s *Server) doPatch(w http.ResponseWriter, r *http.Request) {
+	if s.ReadOnly {
+		w.WriteHeader(StatusForbidden)
+		return
+	}
+
+	path := s.url2path(r.URL)
+	if err := s.checkConditions(r, path); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != partialUpdateType {
+		w.WriteHeader(StatusUnsupportedMediaType)
+		return
+	}
+
+	if r.ContentLength < 0 {
+		w.WriteHeader(StatusLengthRequired)
+		return
+	}
+
+	fi, err := s.stat(path)
+	if err != nil {
+		s.writeError(w, statusError(err, onRead))
+		return
+	}
+	if fi.IsDir() {
+		w.Header().Set("Allow", s.methodsAllowed(path))
+		w.WriteHeader(StatusMethodNotAllowed)
+		return
+	}
+
+	offset, length, err := parseUpdateRange(r.Header.Get("X-Update-Range"), fi.Size())
+	switch {
+	case err == errRangeNotSatisfiable:
+		w.WriteHeader(StatusRangeNotSatisfiable)
+		return
+	case err != nil:
+		w.WriteHeader(StatusBadRequest)
+		return
+	case length < 0:
+		length = r.ContentLength
+	case length != r.ContentLength:
+		// like sabre, the range does not fit the body
+		w.WriteHeader(StatusRangeNotSatisfiable)
+		return
+	}
+
+	if err := s.updateRange(r, path, offset, length); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if etag := s.etag(path); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.WriteHeader(StatusNoContent)
+}
@@ -0,0 +1,93 @@
+package webdav
+
+import "testing"
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header string
+		offset int64
+		length int64
+		ok     bool
+	}{
+		{"bytes 0-0/1", 0, 1, true},
+		{"bytes 0-9/10", 0, 10, true},
+		{"bytes 10-19/*", 10, 10, true},
+		{"bytes 5-5/100", 5, 1, true},
+		{"bytes  2-3/*", 2, 2, true},
+
+		{"", 0, 0, false},
+		{"bytes", 0, 0, false},
+		{"bytes 0-9", 0, 0, false},
+		{"bytes */10", 0, 0, false},
+		{"bytes 9-0/10", 0, 0, false},
+		{"bytes -1-9/10", 0, 0, false},
+		{"bytes 0-10/10", 0, 0, false},
+		{"bytes 0-9/x", 0, 0, false},
+		{"bytes a-9/10", 0, 0, false},
+		{"bytes 0-/10", 0, 0, false},
+		{"items 0-9/10", 0, 0, false},
+		{"bytes=0-9/10", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		offset, length, err := parseContentRange(tt.header)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseContentRange(%q) error %v, want ok %v", tt.header, err, tt.ok)
+			continue
+		}
+		if err == nil && (offset != tt.offset || length != tt.length) {
+			t.Errorf("parseContentRange(%q) = %d, %d, want %d, %d", tt.header, offset, length, tt.offset, tt.length)
+		}
+	}
+}
+
+func TestParseUpdateRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		offset int64
+		length int64
+		err    error
+	}{
+		{"append", 10, 10, -1, nil},
+		{"append", 0, 0, -1, nil},
+		{"bytes=0-3", 10, 0, 4, nil},
+		{"bytes=5-5", 10, 5, 1, nil},
+		{"bytes=8-15", 10, 8, 8, nil},
+		{"bytes=10-12", 10, 10, 3, nil},
+		{"bytes=3-", 10, 3, -1, nil},
+		{"bytes=10-", 10, 10, -1, nil},
+
+		// starts before the end, the length is given by the body
+		{"bytes=-4", 10, 6, -1, nil},
+		{"bytes=-10", 10, 0, -1, nil},
+		{"bytes=-0", 10, 10, -1, nil},
+
+		{"bytes=11-", 10, 0, 0, errRangeNotSatisfiable},
+		{"bytes=11-12", 10, 0, 0, errRangeNotSatisfiable},
+		{"bytes=-11", 10, 0, 0, errRangeNotSatisfiable},
+
+		{"", 10, 0, 0, errInvalidRange},
+		{"bytes=", 10, 0, 0, errInvalidRange},
+		{"bytes=-", 10, 0, 0, errInvalidRange},
+		{"bytes=3", 10, 0, 0, errInvalidRange},
+		{"bytes=3-1", 10, 0, 0, errInvalidRange},
+		{"bytes=-1-3", 10, 0, 0, errInvalidRange},
+		{"bytes=a-3", 10, 0, 0, errInvalidRange},
+		{"bytes=1-b", 10, 0, 0, errInvalidRange},
+		{"bytes=--1", 10, 0, 0, errInvalidRange},
+		{"bytes 0-3", 10, 0, 0, errInvalidRange},
+		{"Append", 10, 0, 0, errInvalidRange},
+	}
+
+	for _, tt := range tests {
+		offset, length, err := parseUpdateRange(tt.header, tt.size)
+		if err != tt.err {
+			t.Errorf("parseUpdateRange(%q, %d) error %v, want %v", tt.header, tt.size, err, tt.err)
+			continue
+		}
+		if err == nil && (offset != tt.offset || length != tt.length) {
+			t.Errorf("parseUpdateRange(%q, %d) = %d, %d, want %d, %d", tt.header, tt.size, offset, length, tt.offset, tt.length)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package webdav
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Resources are identified by slash separated paths rooted at the FileSystem,
+// e.g. "/dir/file". Urls are mapped to paths by removing TrimPrefix, hrefs are
+// built the other way round and percent-encoded.
+// http://www.webdav.org/specs/rfc4918.html#url-handling
+
+// TrimPrefix without trailing slash, "" if nothing is trimmed
+func (s *Server) prefix() string {
+	return strings.TrimSuffix(cleanPath(s.TrimPrefix), "/")
+}
+
+// is the url below TrimPrefix?
+func (s *Server) inNamespace(u *url.URL) bool {
+	prefix := s.prefix()
+	return prefix == "" || u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/")
+}
+
+// convert request url to path, the path of u is already percent-decoded.
+// Urls outside of TrimPrefix are mapped to "".
+func (s *Server) url2path(u *url.URL) string {
+	if !s.inNamespace(u) {
+		return ""
+	}
+	return cleanPath(strings.TrimPrefix(u.Path, s.prefix()))
+}
+
+// convert path to url, collections end with a slash
+func (s *Server) path2url(p string, dir bool) *url.URL {
+	p = s.prefix() + cleanPath(p)
+	if dir && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return &url.URL{Path: p}
+}
+
+// percent-encoded href of path, http://tools.ietf.org/html/rfc3986#section-2.1
+func (s *Server) href(p string, dir bool) string {
+	return s.path2url(p, dir).EscapedPath()
+}
+
+// parse the Destination header, an absolute url or path
+// http://www.webdav.org/specs/rfc4918.html#HEADER_Destination
+func parseDestination(h string) (*url.URL, error) {
+	u, err := url.Parse(h)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Opaque != "" {
+		return nil, ErrInvalidDestination
+	}
+	return u, nil
+}
+
+// path of the member name of the collection dir
+func joinPath(dir, name string) string {
+	return cleanPath(dir + "/" + name)
+}
+
+// path of the collection containing p
+func parentPath(p string) string {
+	return path.Dir(cleanPath(p))
+}
+
+// is p or one of its ancestors an internal file of the server?
+func (s *Server) hiddenPath(p string) bool {
+	for p = cleanPath(p); p != "/"; p = path.Dir(p) {
+		if s.hidden(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package webdav
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var roundTripPaths = []string{
+	"/",
+	"/file",
+	"/dir/file.txt",
+	"/with space",
+	"/dir with space/a b c",
+	"/hash#tag",
+	"/percent%20literal",
+	"/100%",
+	"/question?mark",
+	"/semi;colon",
+	"/plus+sign",
+	"/ümläut/日本語.txt",
+	"/emoji 😀",
+}
+
+func TestHrefRoundTrip(t *testing.T) {
+	for _, prefix := range []string{"", "/webdav/", "/webdav", "/dav dir/"} {
+		s := &Server{TrimPrefix: prefix}
+
+		for _, p := range roundTripPaths {
+			for _, dir := range []bool{false, true} {
+				href := s.href(p, dir)
+
+				if strings.ContainsAny(href, " #?") {
+					t.Errorf("prefix %q: href of %q not escaped: %q", prefix, p, href)
+				}
+				if dir && !strings.HasSuffix(href, "/") {
+					t.Errorf("prefix %q: href of collection %q without trailing slash: %q", prefix, p, href)
+				}
+
+				// hrefs are sent back as request urls and in Destination headers
+				for _, raw := range []string{href, "http://example.com" + href} {
+					u, err := parseDestination(raw)
+					if err != nil {
+						t.Errorf("prefix %q: parsing %q: %v", prefix, raw, err)
+						continue
+					}
+
+					if !s.inNamespace(u) {
+						t.Errorf("prefix %q: %q not in namespace", prefix, raw)
+					}
+					if got := s.url2path(u); got != p {
+						t.Errorf("prefix %q: %q maps to %q, want %q", prefix, raw, got, p)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestUrl2Path(t *testing.T) {
+	tests := []struct {
+		prefix string
+		url    string
+		want   string
+	}{
+		{"", "/", "/"},
+		{"", "/a/b/", "/a/b"},
+		{"", "/a/../b", "/b"},
+		{"", "/a%20b", "/a b"},
+		{"", "/a%23b?x=1#frag", "/a#b"},
+		{"", "/a%3Fb", "/a?b"},
+		{"", "/a%25b", "/a%b"},
+		{"", "/%C3%BC", "/ü"},
+		{"/webdav/", "/webdav", "/"},
+		{"/webdav/", "/webdav/", "/"},
+		{"/webdav/", "/webdav/a%20b/", "/a b"},
+		{"/webdav", "/webdav/a", "/a"},
+		{"/webdav/", "/other/a", ""},
+		{"/webdav/", "/webdavx/a", ""},
+		{"/webdav/", "/", ""},
+	}
+
+	for _, tt := range tests {
+		s := &Server{TrimPrefix: tt.prefix}
+
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.url2path(u); got != tt.want {
+			t.Errorf("prefix %q: url2path(%q) = %q, want %q", tt.prefix, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestHref(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		dir    bool
+		want   string
+	}{
+		{"", "/", true, "/"},
+		{"", "/a b", false, "/a%20b"},
+		{"", "/a#b", false, "/a%23b"},
+		{"", "/a?b", false, "/a%3Fb"},
+		{"", "/a%b", false, "/a%25b"},
+		{"", "/ü", false, "/%C3%BC"},
+		{"", "/dir", true, "/dir/"},
+		{"/webdav/", "/", true, "/webdav/"},
+		{"/webdav/", "/a b", true, "/webdav/a%20b/"},
+		{"/webdav", "/a", false, "/webdav/a"},
+	}
+
+	for _, tt := range tests {
+		s := &Server{TrimPrefix: tt.prefix}
+
+		if got := s.href(tt.path, tt.dir); got != tt.want {
+			t.Errorf("prefix %q: href(%q, %v) = %q, want %q", tt.prefix, tt.path, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		header string
+		path   string
+		ok     bool
+	}{
+		{"http://example.com/webdav/a%20b", "/webdav/a b", true},
+		{"https://example.com:8080/webdav/a%23b", "/webdav/a#b", true},
+		{"/webdav/%C3%BC", "/webdav/ü", true},
+		{"http://example.com", "", false},
+		{"mailto:someone@example.com", "", false},
+		{"http://example.com/%zz", "", false},
+	}
+
+	for _, tt := range tests {
+		u, err := parseDestination(tt.header)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseDestination(%q) error %v, want ok %v", tt.header, err, tt.ok)
+			continue
+		}
+		if err == nil && u.Path != tt.path {
+			t.Errorf("parseDestination(%q) = %q, want %q", tt.header, u.Path, tt.path)
+		}
+	}
+}
+
+func TestDestinationHidden(t *testing.T) {
+	fs := Dir(t.TempDir())
+	sidecar := NewSidecarPropertyStore(fs)
+
+	tests := []struct {
+		dest   string
+		status int
+	}{
+		{"/webdav/b", 0},
+		{"/webdav/dir/b", 0},
+		{"/webdav/.davprops.b", StatusForbidden},
+		{"/webdav/dir/.davprops.b", StatusForbidden},
+		{"/webdav/.davuploads", StatusForbidden},
+		{"/webdav/.davuploads/x/1", StatusForbidden},
+		{"/webdav/.davtmp-0123456789abcdef", StatusForbidden},
+		{"/webdav/.davtmp-0123456789abcdef/b", StatusForbidden},
+		{"/webdav/.davtmp-notes", 0},
+		{"/webdav/.davtmp-0123456789ABCDEF", 0},
+		{"/webdav/.davtmp-0123456789abcdef0", 0},
+		{"/webdav/uploads", StatusForbidden},
+		{"/webdav/uploads/x/.file", StatusForbidden},
+		{"/webdav/a", StatusForbidden},
+		{"/other/b", StatusBadGateway},
+	}
+
+	// sidecar files stay hidden behind the fallback of the xattr store
+	for _, props := range []PropertyStore{sidecar, NewXattrPropertyStore(fs, sidecar)} {
+		s := &Server{
+			Fs:          fs,
+			TrimPrefix:  "/webdav/",
+			Props:       props,
+			UploadsPath: "/uploads/",
+		}
+
+		for _, tt := range tests {
+			r, err := http.NewRequest("COPY", "http://example.com/webdav/a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Destination", "http://example.com"+tt.dest)
+
+			if _, status := s.destination(r, "/a"); status != tt.status {
+				t.Errorf("%T: Destination %q: status %d, want %d", props, tt.dest, status, tt.status)
+			}
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Property is a dead property, stored by the server but
+// neither interpreted nor generated by it.
+// http://www.webdav.org/specs/rfc4918.html#dead.properties
+type Property struct {
+	Name xml.Name
+
+	// value of xml:lang in scope of the property, if any
+	Lang string
+
+	// xml content of the property element
+	InnerXML string
+}
+
+// A PropertyStore holds the dead properties of the resources of a FileSystem.
+// Paths are slash separated and rooted, like the names given to a FileSystem.
+type PropertyStore interface {
+	// Get returns the dead property name of the resource at path,
+	// ErrNoSuchProperty if it is not set.
+	Get(path string, name xml.Name) (Property, error)
+
+	// Set creates or replaces the given properties of the resource at path.
+	Set(path string, props ...Property) error
+
+	// Remove deletes the named properties of the resource at path,
+	// names that are not set are ignored.
+	Remove(path string, names ...xml.Name) error
+
+	// List returns all dead properties of the resource at path.
+	List(path string) ([]Property, error)
+
+	// Copy replaces the properties of dst with those of src. It is
+	// called for every single resource the Server copies.
+	Copy(src, dst string) error
+
+	// Move transfers the properties of src and all its members to dst,
+	// after the Server has renamed src as a whole.
+	Move(src, dst string) error
+
+	// Delete removes all properties of the resource at path. It is
+	// called for every single resource the Server deletes.
+	Delete(path string) error
+}
+
+// A MemPropertyStore keeps dead properties in memory,
+// they are lost when the server is restarted.
+type MemPropertyStore struct {
+	mu    sync.Mutex
+	props map[string]map[xml.Name]Property
+}
+
+func NewMemPropertyStore() *MemPropertyStore {
+	return &MemPropertyStore{props: map[string]map[xml.Name]Property{}}
+}
+
+func (m *MemPropertyStore) Get(p string, name xml.Name) (Property, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prop, ok := m.props[cleanPath(p)][name]
+	if !ok {
+		return prop, ErrNoSuchProperty
+	}
+	return prop, nil
+}
+
+func (m *MemPropertyStore) Set(p string, props ...Property) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p = cleanPath(p)
+	if m.props[p] == nil {
+		m.props[p] = map[xml.Name]Property{}
+	}
+
+	for _, prop := range props {
+		m.props[p][prop.Name] = prop
+	}
+	return nil
+}
+
+func (m *MemPropertyStore) Remove(p string, names ...xml.Name) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p = cleanPath(p)
+	for _, n := range names {
+		delete(m.props[p], n)
+	}
+
+	if len(m.props[p]) == 0 {
+		delete(m.props, p)
+	}
+	return nil
+}
+
+func (m *MemPropertyStore) List(p string) ([]Property, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ret []Property
+	for _, prop := range m.props[cleanPath(p)] {
+		ret = append(ret, prop)
+	}
+	return ret, nil
+}
+
+func (m *MemPropertyStore) Copy(src, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	src, dst = cleanPath(src), cleanPath(dst)
+	delete(m.props, dst)
+
+	if len(m.props[src]) > 0 {
+		m.props[dst] = map[xml.Name]Property{}
+		for n, prop := range m.props[src] {
+			m.props[dst][n] = prop
+		}
+	}
+	return nil
+}
+
+func (m *MemPropertyStore) Move(src, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	src, dst = cleanPath(src), cleanPath(dst)
+
+	moved := map[string]map[xml.Name]Property{}
+	for p, props := range m.props {
+		switch {
+		case p == src:
+			moved[dst] = props
+		case isDescendant(src, p):
+			moved[dst+strings.TrimPrefix(p, src)] = props
+		case p == dst || isDescendant(dst, p):
+			// replaced by the moved resource
+		default:
+			continue
+		}
+		delete(m.props, p)
+	}
+
+	for p, props := range moved {
+		m.props[p] = props
+	}
+	return nil
+}
+
+func (m *MemPropertyStore) Delete(p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.props, cleanPath(p))
+	return nil
+}
+
+// live properties in the DAV: namespace generated by the server
+// http://www.webdav.org/specs/rfc4918.html#dav.properties
+var liveProperties = map[string]bool{
+	"creationdate":       true,
+	"displayname":        true,
+	"getcontentlanguage": true,
+	"getcontentlength":   true,
+	"getcontenttype":     true,
+	"getetag":            true,
+	"getlastmodified":    true,
+	"lockdiscovery":      true,
+	"resourcetype":       true,
+	"supportedlock":      true,
+
+	// http://tools.ietf.org/html/rfc4331#section-3
+	"quota-available-bytes": true,
+	"quota-used-bytes":      true,
+}
+
+// live properties that can not be changed by PROPPATCH
+var protectedProperties = map[string]bool{
+	"creationdate":     true,
+	"getcontentlength": true,
+	"getcontenttype":   true,
+	"getetag":          true,
+	"getlastmodified":  true,
+	"lockdiscovery":    true,
+	"resourcetype":     true,
+	"supportedlock":    true,
+
+	"quota-available-bytes": true,
+	"quota-used-bytes":      true,
+}
+
+func isProtected(name xml.Name) bool {
+	return (name.Space == "DAV:" && protectedProperties[name.Local]) || name == ctagName || name == checksumsName
+}
+
+// apply instructions to the dead properties of a resource, all or nothing.
+// Returns the resulting properties and the status code for each named property.
+func applyPropPatch(props []Property, patches []PropInstruction) ([]Property, map[xml.Name]int, bool) {
+	current := map[xml.Name]Property{}
+	for _, p := range props {
+		current[p.Name] = p
+	}
+
+	status := map[xml.Name]int{}
+	ok := true
+
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if isProtected(p.Name) {
+				status[p.Name] = StatusForbidden
+				ok = false
+				continue
+			}
+
+			status[p.Name] = StatusOK
+			if patch.Remove {
+				delete(current, p.Name)
+			} else {
+				current[p.Name] = p
+			}
+		}
+	}
+
+	if !ok {
+		// everything else fails because of the forbidden properties
+		for n, s := range status {
+			if s == StatusOK {
+				status[n] = StatusFailedDependency
+			}
+		}
+		return props, status, false
+	}
+
+	ret := make([]Property, 0, len(current))
+	for _, p := range current {
+		ret = append(ret, p)
+	}
+	return ret, status, true
+}
+
+// dead properties of path
+func (s *Server) deadProperties(p string) map[xml.Name]Property {
+	ret := map[xml.Name]Property{}
+
+	props, err := s.Props.List(p)
+	if err != nil {
+		log.Println("DAV:", "listing properties failed", p, err)
+	}
+
+	for _, prop := range props {
+		ret[prop.Name] = prop
+	}
+	return ret
+}
+
+// apply instructions to the dead properties of path, all or nothing
+func (s *Server) patchProperties(p string, patches []PropInstruction) (map[xml.Name]int, error) {
+	s.propMu.Lock()
+	defer s.propMu.Unlock()
+
+	props, err := s.Props.List(p)
+	if err != nil {
+		return nil, err
+	}
+
+	result, status, ok := applyPropPatch(props, patches)
+	if !ok {
+		return status, nil
+	}
+
+	before := map[xml.Name]bool{}
+	for _, prop := range props {
+		before[prop.Name] = true
+	}
+	after := map[xml.Name]bool{}
+	for _, prop := range result {
+		after[prop.Name] = true
+	}
+
+	var removed, added []xml.Name
+	for n := range before {
+		if !after[n] {
+			removed = append(removed, n)
+		}
+	}
+	for n := range after {
+		if !before[n] {
+			added = append(added, n)
+		}
+	}
+
+	if err := s.Props.Remove(p, removed...); err != nil {
+		return nil, err
+	}
+	if err := s.Props.Set(p, result...); err != nil {
+		// restore previous state
+		s.Props.Remove(p, added...)
+		s.Props.Set(p, props...)
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// drop the dead properties of a deleted resource
+func (s *Server) deleteProperties(p string) {
+	if err := s.Props.Delete(p); err != nil {
+		log.Println("DAV:", "deleting properties failed", p, err)
+	}
+}
+
+// is name an internal file of the server, e.g. a property sidecar?
+func (s *Server) hidden(name string) bool {
+	if isTemp(name) || isUploadsDir(name) {
+		return true
+	}
+
+	if h, ok := s.Props.(interface {
+		Hidden(name string) bool
+	}); ok && h.Hidden(name) {
+		return true
+	}
+	return false
+}
+
+// names of the live and dead properties of the resource at p
+func (s *Server) propertyNames(p string, fi os.FileInfo) []xml.Name {
+	var ret []xml.Name
+	for _, n := range []string{
+		"creationdate", "displayname",
+		"getcontentlanguage", "getcontentlength",
+		"getcontenttype", "getetag",
+		"getlastmodified", "lockdiscovery",
+		"resourcetype", "supportedlock",
+	} {
+		if hasLiveProperty(fi, davName(n)) {
+			ret = append(ret, davName(n))
+		}
+	}
+
+	if hasLiveProperty(fi, ctagName) {
+		ret = append(ret, ctagName)
+	}
+
+	for n := range s.deadProperties(p) {
+		if n.Space != "DAV:" || !liveProperties[n.Local] {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// is the live property defined for the resource? Its value is not computed,
+// it may still fail to be generated, e.g. the entity tag of an unreadable file.
+func hasLiveProperty(fi os.FileInfo, name xml.Name) bool {
+	if name == ctagName {
+		return fi.IsDir()
+	}
+	if name.Space != "DAV:" {
+		return false
+	}
+
+	switch name.Local {
+	case "getcontentlength", "getcontenttype", "getlastmodified":
+		return !fi.IsDir()
+	case "quota-available-bytes", "quota-used-bytes":
+		// only on request, http://tools.ietf.org/html/rfc4331#section-3
+		return false
+	}
+	return liveProperties[name.Local]
+}
+
+// value of a live property, false if it is not defined for the resource.
+// ctag returns the change tag of a collection, it is computed only once
+// for all properties of the resource.
+// http://www.webdav.org/specs/rfc4918.html#dav.properties
+func (s *Server) liveProperty(p string, fi os.FileInfo, name xml.Name, ctag func() string) (Property, bool) {
+	prop := Property{Name: name}
+
+	text := func(v string) (Property, bool) {
+		buf := new(bytes.Buffer)
+		xml.EscapeText(buf, []byte(v))
+		prop.InnerXML = buf.String()
+		return prop, true
+	}
+
+	if name == ctagName && fi.IsDir() {
+		return text(ctag())
+	}
+	if name.Space != "DAV:" {
+		return prop, false
+	}
+
+	switch name.Local {
+	case "creationdate":
+		return text(fi.ModTime().Format("2006-01-02T15:04:05Z07:00"))
+	case "displayname":
+		return text(fi.Name())
+	case "getcontentlanguage":
+		return text("en")
+	case "getcontentlength":
+		if !fi.IsDir() {
+			return text(strconv.FormatInt(fi.Size(), 10))
+		}
+	case "getcontenttype":
+		if !fi.IsDir() {
+			return text(mime.TypeByExtension(filepath.Ext(fi.Name())))
+		}
+	case "getlastmodified":
+		if !fi.IsDir() {
+			return text(fi.ModTime().UTC().Format(http.TimeFormat))
+		}
+	case "resourcetype":
+		if fi.IsDir() {
+			prop.InnerXML = `<collection xmlns="DAV:"/>`
+		}
+		return prop, true
+	case "supportedlock":
+		prop.InnerXML = `<lockentry xmlns="DAV:"><lockscope><exclusive/></lockscope><locktype><write/></locktype></lockentry>` +
+			`<lockentry xmlns="DAV:"><lockscope><shared/></lockscope><locktype><write/></locktype></lockentry>`
+		return prop, true
+	case "lockdiscovery":
+		buf := new(bytes.Buffer)
+		e := xml.NewEncoder(buf)
+		for _, al := range s.lockDiscovery(p).ActiveLocks {
+			if err := e.Encode(al); err != nil {
+				return prop, false
+			}
+		}
+		prop.InnerXML = buf.String()
+		return prop, true
+	case "getetag":
+		if fi.IsDir() {
+			return text(collectionETag(ctag()))
+		}
+		if etag := s.etagOf(p, fi); etag != "" {
+			return text(etag)
+		}
+	case "quota-available-bytes", "quota-used-bytes":
+		if v, ok := s.quotaProperty(p, fi, name); ok {
+			return text(v)
+		}
+	}
+
+	return prop, false
+}
+
+// propstat elements of the named properties of the resource at p, grouped by status.
+// Only names are returned if values is false, unknown properties are omitted if all is set.
+func (s *Server) propstats(p string, fi os.FileInfo, names []xml.Name, values, all bool) []Propstat {
+	dead := s.deadProperties(p)
+
+	// used by getctag and getetag of collections, the listing is read once
+	var ctag string
+	ctagOnce := func() string {
+		if ctag == "" {
+			ctag = s.ctag(p, fi)
+		}
+		return ctag
+	}
+
+	var found, notFound Prop
+	for _, name := range names {
+		prop, ok := dead[name]
+		switch {
+		case ok:
+		case !values:
+			// names only, values are not computed
+			prop, ok = Property{Name: name}, hasLiveProperty(fi, name)
+		default:
+			prop, ok = s.liveProperty(p, fi, name, ctagOnce)
+		}
+
+		if !ok {
+			if !all {
+				notFound = append(notFound, Property{Name: name})
+			}
+			continue
+		}
+
+		if !values {
+			prop = Property{Name: name}
+		}
+		found = append(found, prop)
+	}
+
+	var ret []Propstat
+	if len(found) > 0 || len(notFound) == 0 {
+		ret = append(ret, Propstat{Prop: found, Status: StatusLine(StatusOK)})
+	}
+	if len(notFound) > 0 {
+		ret = append(ret, Propstat{Prop: notFound, Status: StatusLine(StatusNotFound)})
+	}
+	return ret
+}
@@ -0,0 +1,178 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A QuotaReporter is a FileSystem that knows the storage used by and
+// available to the tree at path, e.g. of the underlying disk.
+// http://tools.ietf.org/html/rfc4331
+type QuotaReporter interface {
+	Quota(path string) (used, available int64, err error)
+}
+
+// quota properties are only returned if requested by name
+// http://tools.ietf.org/html/rfc4331#section-3
+var quotaUsedName = davName("quota-used-bytes")
+
+// usage of the tree is recomputed after this time, to notice external changes
+const quotaUsageTTL = time.Minute
+
+// cached number of bytes used by the tree, the changes made through the
+// server are applied to it
+type quotaUsage struct {
+	mu    sync.Mutex
+	valid bool
+	at    time.Time
+	used  int64
+
+	// changed by an unknown number of bytes since the last walk
+	stale bool
+
+	// closed once the running walk of the tree is done, nil if there is none
+	walking chan struct{}
+}
+
+// number of bytes used by the files of the tree at p
+func (s *Server) treeSize(p string) int64 {
+	fi, err := s.stat(p)
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	s.walk(context.Background(), p, fi, InfiniteDepth, func(p string, fi os.FileInfo) error {
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// number of bytes used by the whole tree, including chunked uploads. Once
+// known, the tree is walked again in the background if the usage is stale or
+// expired, meanwhile the last known usage is good enough.
+func (s *Server) usedBytes() int64 {
+	u := &s.usage
+
+	u.mu.Lock()
+	if u.valid {
+		defer u.mu.Unlock()
+
+		if (u.stale || time.Since(u.at) > quotaUsageTTL) && u.walking == nil {
+			u.walking = make(chan struct{})
+			go s.measureUsage()
+		}
+		return u.used
+	}
+
+	// the first walk is waited for
+	done := u.walking
+	if done == nil {
+		done = make(chan struct{})
+		u.walking = done
+		go s.measureUsage()
+	}
+	u.mu.Unlock()
+
+	<-done
+	return s.usedBytes()
+}
+
+// walk the tree and the upload sessions, without holding the lock
+func (s *Server) measureUsage() {
+	u := &s.usage
+
+	u.mu.Lock()
+	u.stale = false
+	u.mu.Unlock()
+
+	used := s.treeSize("/") + s.uploadBytes()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.used, u.valid, u.at = used, true, time.Now()
+	close(u.walking)
+	u.walking = nil
+}
+
+// account delta bytes written to or removed from the tree
+func (s *Server) grew(delta int64) {
+	u := &s.usage
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.used += delta
+	if u.walking != nil {
+		// the running walk may or may not see it
+		u.stale = true
+	}
+}
+
+// account a change of the tree by an unknown number of bytes, e.g. a deleted
+// collection. The usage is recomputed in the background.
+func (s *Server) resized() {
+	u := &s.usage
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.stale = true
+}
+
+// can need more bytes be stored without exceeding QuotaLimit?
+func (s *Server) quotaAllows(need int64) bool {
+	if s.QuotaLimit <= 0 || need <= 0 {
+		return true
+	}
+	return s.usedBytes()+need <= s.QuotaLimit
+}
+
+// used and available bytes of the tree, false if unknown
+func (s *Server) quota(p string) (used, available int64, ok bool) {
+	if q, isQuota := s.Fs.(QuotaReporter); isQuota {
+		if u, a, err := q.Quota(p); err == nil {
+			used, available, ok = u, a, true
+		}
+	}
+
+	if s.QuotaLimit > 0 {
+		used = s.usedBytes()
+
+		left := s.QuotaLimit - used
+		if left < 0 {
+			left = 0
+		}
+		if !ok || left < available {
+			available = left
+		}
+		ok = true
+	}
+
+	return used, available, ok
+}
+
+// value of a quota property of the collection p
+func (s *Server) quotaProperty(p string, fi os.FileInfo, name xml.Name) (string, bool) {
+	if !fi.IsDir() {
+		return "", false
+	}
+
+	used, available, ok := s.quota(p)
+	if !ok {
+		return "", false
+	}
+
+	if name == quotaUsedName {
+		return strconv.FormatInt(used, 10), true
+	}
+	return strconv.FormatInt(available, 10), true
+}
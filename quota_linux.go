@@ -0,0 +1,14 @@
+package webdav
+
+import "syscall"
+
+// used and available bytes of the file system holding path
+func statfs(path string) (used, available int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+
+	bsize := int64(st.Bsize)
+	return int64(st.Blocks-st.Bfree) * bsize, int64(st.Bavail) * bsize, nil
+}
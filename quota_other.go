@@ -0,0 +1,9 @@
+//go:build !linux
+
+package webdav
+
+// disk usage is only known on linux
+
+func statfs(path string) (used, available int64, err error) {
+	return 0, 0, ErrNotImplemented
+}
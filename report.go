@@ -0,0 +1,312 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// A Report is a REPORT request, http://tools.ietf.org/html/rfc3253#section-3.6
+type Report struct {
+	// root element of the request body, it names the report
+	Body *Node
+
+	// value of the Depth header, 0 if it is missing, or InfiniteDepth
+	Depth int
+
+	// existing resource of the Request-URI
+	Path string
+
+	Server  *Server
+	Request *http.Request
+}
+
+// A ReportHandler answers a REPORT, usually with a multistatus.
+type ReportHandler func(w http.ResponseWriter, rep *Report)
+
+// HandleReport registers the handler for reports with the root element name.
+// It replaces a built-in or previously registered handler and must be called
+// before the Server is used.
+func (s *Server) HandleReport(name xml.Name, h ReportHandler) {
+	if s.Reports == nil {
+		s.Reports = map[xml.Name]ReportHandler{}
+	}
+	s.Reports[name] = h
+}
+
+// register the built-in reports not replaced by the user
+func (s *Server) initReports() {
+	for name, h := range map[xml.Name]ReportHandler{
+		davName("expand-property"): reportExpandProperty,
+		davName("sync-collection"): reportSyncCollection,
+	} {
+		if _, ok := s.Reports[name]; !ok {
+			s.HandleReport(name, h)
+		}
+	}
+}
+
+// The REPORT method, http://tools.ietf.org/html/rfc3253#section-3.6
+func (s *Server) doReport(w http.ResponseWriter, r *http.Request) {
+	if !s.Listings {
+		w.Header().Set("Allow", s.methodsAllowed(s.url2path(r.URL)))
+		w.WriteHeader(StatusMethodNotAllowed)
+		return
+	}
+
+	rep := &Report{
+		Path:    s.url2path(r.URL),
+		Server:  s,
+		Request: r,
+	}
+
+	switch r.Header.Get("Depth") {
+	case "", "0":
+	case "1":
+		rep.Depth = 1
+	case "infinity":
+		rep.Depth = InfiniteDepth
+	default:
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	var err error
+	if rep.Body, err = NodeFromXml(r.Body); err != nil {
+		s.writeError(w, bodyError(err))
+		return
+	}
+
+	if !s.pathExists(rep.Path) {
+		w.WriteHeader(StatusNotFound)
+		return
+	}
+
+	h, ok := s.Reports[rep.Body.Name]
+	if !ok {
+		s.writeError(w, NewStatusError(StatusForbidden, davName("supported-report")))
+		return
+	}
+	h(w, rep)
+}
+
+// PropResponse returns the response element with the named properties of the
+// resource at path, as used in PROPFIND multistatus responses.
+func (s *Server) PropResponse(path string, names []xml.Name) (Response, error) {
+	fi, err := s.stat(path)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return Response{
+		Href:     []string{s.href(path, fi.IsDir())},
+		Propstat: s.propstats(path, fi, names, true, false),
+	}, nil
+}
+
+// expand the href values of properties into responses with properties of the
+// referenced resources, http://tools.ietf.org/html/rfc3253#section-3.8
+func reportExpandProperty(w http.ResponseWriter, rep *Report) {
+	s := rep.Server
+
+	if rep.Depth == InfiniteDepth && !s.AllowInfiniteDepth {
+		s.writeError(w, NewStatusError(StatusForbidden, davName("propfind-finite-depth")))
+		return
+	}
+
+	fi, err := s.stat(rep.Path)
+	if err != nil {
+		w.WriteHeader(StatusNotFound)
+		return
+	}
+
+	ms := NewMultiStatusWriter(w)
+	s.walkResponses(rep.Request.Context(), w, ms, rep.Path, fi, rep.Depth, func(p string, fi os.FileInfo) error {
+		return ms.Write(s.expandProperties(p, fi, rep.Body))
+	})
+}
+
+// response with the properties requested by the property children of spec
+func (s *Server) expandProperties(p string, fi os.FileInfo, spec *Node) Response {
+	var names []xml.Name
+	nested := map[xml.Name]*Node{}
+
+	for _, n := range spec.GetChildrens(davName("property")) {
+		name := xml.Name{Space: "DAV:"}
+		for _, a := range n.Attr {
+			switch a.Name {
+			case xml.Name{Local: "name"}:
+				name.Local = a.Value
+			case xml.Name{Local: "namespace"}:
+				name.Space = a.Value
+			}
+		}
+
+		if name.Local == "" {
+			continue
+		}
+		names = append(names, name)
+
+		if n.HasChildren(davName("property")) {
+			nested[name] = n
+		}
+	}
+
+	propstats := s.propstats(p, fi, names, true, false)
+	for i := range propstats {
+		for j, prop := range propstats[i].Prop {
+			if spec, ok := nested[prop.Name]; ok && prop.InnerXML != "" {
+				propstats[i].Prop[j].InnerXML = s.expandHrefs(prop.InnerXML, spec)
+			}
+		}
+	}
+
+	return Response{
+		Href:     []string{s.href(p, fi.IsDir())},
+		Propstat: propstats,
+	}
+}
+
+// replace the href elements of a property value by responses
+func (s *Server) expandHrefs(value string, spec *Node) string {
+	root, err := NodeFromXml(strings.NewReader(`<value>` + value + `</value>`))
+	if err != nil {
+		return value
+	}
+
+	var buf strings.Builder
+	e := xml.NewEncoder(&buf)
+	for _, n := range root.Children {
+		if !n.is(davName("href")) {
+			buf.WriteString(n.String())
+			continue
+		}
+
+		href := strings.TrimSpace(n.Text())
+		resp := Response{Href: []string{href}, Status: StatusLine(StatusNotFound)}
+
+		if u, err := url.Parse(href); err == nil && s.inNamespace(u) {
+			p := s.url2path(u)
+			if fi, err := s.stat(p); err == nil && !s.hiddenPath(p) {
+				resp = s.expandProperties(p, fi, spec)
+			}
+		}
+
+		if err := e.Encode(resp); err != nil {
+			return value
+		}
+	}
+
+	return buf.String()
+}
+
+// changes of the members of a collection since a sync-token
+// http://tools.ietf.org/html/rfc6578#section-3.2
+func reportSyncCollection(w http.ResponseWriter, rep *Report) {
+	s, root := rep.Server, rep.Body
+
+	// the scope is given by sync-level
+	if rep.Depth != 0 {
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	var depth int
+	switch n := root.FirstChildren(davName("sync-level")); {
+	case n == nil:
+		w.WriteHeader(StatusBadRequest)
+		return
+	case n.Text() == "1":
+		depth = 1
+	case n.Text() == "infinite":
+		// disabled like PROPFIND with Depth infinity
+		if !s.AllowInfiniteDepth {
+			s.writeError(w, NewStatusError(StatusForbidden, davName("number-of-matches-within-limits")))
+			return
+		}
+		depth = InfiniteDepth
+	default:
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	var names []xml.Name
+	if prop := root.FirstChildren(davName("prop")); prop != nil {
+		for _, n := range prop.GetChildrens(anyName) {
+			names = append(names, n.Name)
+		}
+	}
+
+	var token string
+	if n := root.FirstChildren(davName("sync-token")); n != nil {
+		token = strings.TrimSpace(n.Text())
+	}
+
+	path := rep.Path
+	fi, err := s.stat(path)
+	if err != nil {
+		w.WriteHeader(StatusNotFound)
+		return
+	}
+	if !fi.IsDir() {
+		s.writeError(w, NewStatusError(StatusForbidden, davName("supported-report")))
+		return
+	}
+
+	ms := NewMultiStatusWriter(w)
+
+	if token == "" {
+		// initial sync, all members
+		ms.SyncToken = s.syncToken()
+		exceeded := s.walkLimit()
+
+		s.walkResponses(rep.Request.Context(), w, ms, path, fi, depth, func(p string, fi os.FileInfo) error {
+			if exceeded() {
+				// truncated, http://tools.ietf.org/html/rfc6578#section-3.6
+				// without a token, the members not listed could never be synced
+				ms.SyncToken = ""
+				ms.Write(Response{
+					Href:                []string{s.href(path, true)},
+					Status:              StatusLine(StatusInsufficientStorage),
+					Error:               &Error{Conditions: []Condition{{XMLName: davName("number-of-matches-within-limits")}}},
+					ResponseDescription: "sync-collection limit reached",
+				})
+				return errStopWalk
+			}
+			if p == path {
+				return nil
+			}
+			return ms.Write(Response{
+				Href:     []string{s.href(p, fi.IsDir())},
+				Propstat: s.propstats(p, fi, names, true, false),
+			})
+		})
+		return
+	}
+
+	changed, current, err := s.changesSince(path, token, depth)
+	if err != nil {
+		s.writeError(w, NewStatusError(StatusForbidden, davName("valid-sync-token")))
+		return
+	}
+	ms.SyncToken = current
+
+	for _, p := range changed {
+		resp, err := s.PropResponse(p, names)
+		if err != nil {
+			// removed member
+			resp = Response{
+				Href:   []string{s.href(p, false)},
+				Status: StatusLine(StatusNotFound),
+			}
+		}
+
+		if err := ms.Write(resp); err != nil {
+			return
+		}
+	}
+
+	ms.Close()
+}
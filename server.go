@@ -2,20 +2,26 @@ package webdav
 
 import (
 	"bytes"
+	"context"
+	"encoding/xml"
 	"io"
 	"log"
-	"mime"
 	"net/http"
-	"net/url"
-	"path/filepath"
-	"strconv"
+	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 func Handler(root FileSystem) http.Handler {
 	return &Server{Fs: root}
 }
 
+// A Server serves the files of Fs over WebDAV. A few names are reserved for
+// files of its own and hidden from clients: temporary files of uploads named
+// ".davtmp-" followed by 16 hex digits, which are removed if left over on
+// start, the chunked upload sessions in "/.davuploads" and the files of a
+// property store with a Hidden method, e.g. ".davprops.*" of the sidecar store.
 type Server struct {
 	// trimmed path prefix
 	TrimPrefix string
@@ -26,12 +32,96 @@ type Server struct {
 	// generate directory listings?
 	Listings bool
 
+	// allow PROPFIND with Depth infinity and sync-collection reports with
+	// sync-level infinite, the walk stops at the given number of resources
+	// or duration if they are not zero
+	AllowInfiniteDepth  bool
+	MaxPropfindNodes    int
+	MaxPropfindDuration time.Duration
+
+	// number of changes kept for sync-collection reports, 10000 if zero.
+	// Clients with older sync tokens have to start over.
+	SyncJournalSize int
+
+	// maximum number of bytes stored in the tree, enforced on PUT and COPY
+	// with 507 Insufficient Storage. Not limited if zero.
+	QuotaLimit int64
+
+	// collection of chunked upload sessions in the style of Nextcloud chunking v2,
+	// e.g. "/uploads/". Sessions expire after UploadExpiry without a new chunk,
+	// 24 hours if zero. Disabled if empty.
+	UploadsPath  string
+	UploadExpiry time.Duration
+
+	// maximum duration of a request, recursive operations and file copies stop
+	// with 503 Service Unavailable once it is exceeded. Not limited if zero.
+	RequestTimeout time.Duration
+
 	// access to a collection of named files
 	Fs FileSystem
+
+	// write locks held on resources, created on first use if nil
+	Locks *LockManager
+
+	// dead properties set by PROPPATCH, kept in memory if nil
+	Props PropertyStore
+
+	// entity tags of files, ModTimeETag if nil. Collections
+	// use their change tag, see getctag.
+	ETag ETagFunc
+
+	// REPORT handlers by the name of the request body root element, see
+	// HandleReport. DAV:expand-property and DAV:sync-collection are built in.
+	Reports map[xml.Name]ReportHandler
+
+	propMu  sync.Mutex
+	changes changeTracker
+	usage   quotaUsage
+	once    sync.Once
+}
+
+// set defaults for unset optional fields
+func (s *Server) init() {
+	s.once.Do(func() {
+		if s.Locks == nil {
+			s.Locks = NewLockManager()
+		}
+		if s.Props == nil {
+			s.Props = NewMemPropertyStore()
+		}
+		s.changes.init()
+		s.initReports()
+
+		// file system timestamps may be coarse, uploads started from
+		// now on must not be mistaken for leftovers
+		if !s.ReadOnly {
+			go func() {
+				s.removeTempFiles("/", time.Now().Add(-time.Minute))
+				s.removeExpiredUploads()
+			}()
+		}
+	})
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("DAV:", r.RemoteAddr, r.Method, r.URL)
+	s.init()
+
+	if s.RequestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.RequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	if !s.inNamespace(r.URL) || s.hiddenPath(s.url2path(r.URL)) {
+		http.Error(w, r.URL.Path, StatusNotFound)
+		return
+	}
+
+	if s.isUpload(s.url2path(r.URL)) {
+		s.serveUpload(w, r)
+		return
+	}
 
 	switch r.Method {
 	case "OPTIONS":
@@ -47,6 +137,8 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.doDelete(w, r)
 	case "PUT":
 		s.doPut(w, r)
+	case "PATCH":
+		s.doPatch(w, r)
 
 	case "PROPFIND":
 		s.doPropfind(w, r)
@@ -64,6 +156,9 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "UNLOCK":
 		s.doUnlock(w, r)
 
+	case "REPORT":
+		s.doReport(w, r)
+
 	default:
 		log.Println("DAV:", "unknown method", r.Method)
 		w.WriteHeader(StatusBadRequest)
@@ -78,54 +173,77 @@ func (s *Server) methodsAllowed(path string) string {
 	allowed := "OPTIONS, GET, HEAD, POST, DELETE, TRACE, PROPPATCH, COPY, MOVE, LOCK, UNLOCK"
 
 	if s.Listings {
-		allowed += ", PROPFIND"
+		allowed += ", PROPFIND, REPORT"
 	}
 
 	if s.pathIsDirectory(path) {
 		allowed += ", PUT"
+	} else if _, ok := s.Fs.(OpenFiler); ok {
+		allowed += ", PATCH"
 	}
 
 	return allowed
 }
 
-// convert request url to path
-func (s *Server) url2path(u *url.URL) string {
-	if u.Path == "" {
-		return "/"
+// stat the resource at path, without opening it if the FileSystem is a Stater
+func (s *Server) stat(path string) (os.FileInfo, error) {
+	if st, ok := s.Fs.(Stater); ok {
+		return st.Stat(path)
 	}
 
-	if p := strings.TrimPrefix(u.Path, s.TrimPrefix); len(p) < len(u.Path) {
-		return strings.Trim(p, "/")
+	f, err := s.Fs.Open(path)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	return "/"
+	return f.Stat()
 }
 
-// convert path to url
-func (s *Server) path2url(p string) *url.URL {
-	return &url.URL{Path: "/" + s.TrimPrefix + "/" + p}
+// open path with flags and permissions if the FileSystem is an OpenFiler,
+// otherwise only opening for reading and creating with truncation is possible
+func (s *Server) openFile(ctx context.Context, path string, flag int, perm os.FileMode) (File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if of, ok := s.Fs.(OpenFiler); ok {
+		return of.OpenFile(path, flag, perm)
+	}
+
+	if flag&os.O_CREATE != 0 {
+		if flag&os.O_EXCL != 0 && s.pathExists(path) {
+			return nil, os.ErrExist
+		}
+		return s.create(ctx, path)
+	}
+	return s.open(ctx, path)
 }
 
-// does path exists?
-func (s *Server) pathExists(path string) bool {
-	f, err := s.Fs.Open(path)
-	if err != nil {
-		return false
+// rename oldpath to newpath, ErrNotImplemented if the FileSystem is no Renamer
+func (s *Server) rename(oldpath, newpath string) error {
+	if rn, ok := s.Fs.(Renamer); ok {
+		return rn.Rename(oldpath, newpath)
 	}
-	defer f.Close()
+	return ErrNotImplemented
+}
 
-	return true
+// change the times of path, ErrNotImplemented if the FileSystem is no Chtimeser
+func (s *Server) chtimes(path string, atime, mtime time.Time) error {
+	if ct, ok := s.Fs.(Chtimeser); ok {
+		return ct.Chtimes(path, atime, mtime)
+	}
+	return ErrNotImplemented
+}
+
+// does path exists?
+func (s *Server) pathExists(path string) bool {
+	_, err := s.stat(path)
+	return err == nil
 }
 
 // is path a directory?
 func (s *Server) pathIsDirectory(path string) bool {
-	f, err := s.Fs.Open(path)
-	if err != nil {
-		return false
-	}
-	defer f.Close()
-
-	fi, err := f.Stat()
+	fi, err := s.stat(path)
 	if err != nil {
 		return false
 	}
@@ -133,8 +251,8 @@ func (s *Server) pathIsDirectory(path string) bool {
 	return fi.IsDir()
 }
 
-func (s *Server) directoryContents(path string) []string {
-	f, err := s.Fs.Open(path)
+func (s *Server) directoryContents(ctx context.Context, path string) []string {
+	f, err := s.open(ctx, path)
 	if err != nil {
 		return nil
 	}
@@ -145,37 +263,151 @@ func (s *Server) directoryContents(path string) []string {
 		return nil
 	}
 
-	ret := make([]string, len(fi))
-	for k, i := range fi {
+	ret := make([]string, 0, len(fi))
+	for _, i := range fi {
 		name := i.Name()
+		if s.hidden(name) {
+			continue
+		}
+
 		if i.IsDir() {
 			name += "/"
 		}
-		ret[k] = name
+		ret = append(ret, name)
 	}
 
 	return ret
 }
 
-// is path in request locked?
-func (s *Server) isLockedRequest(r *http.Request) bool {
-	return s.isLocked(
-		s.url2path(r.URL),
-		r.Header.Get("If")+r.Header.Get("Lock-Token"))
+// is path locked and none of its lock tokens submitted?
+func (s *Server) isLocked(path string, tokens []string) bool {
+	return !submitted(s.Locks.Locks(path), tokens)
+}
+
+// is the collection containing path locked and none of its lock tokens submitted?
+// Members may not be added to or removed from a locked collection, even by a lock of depth 0.
+// http://www.webdav.org/specs/rfc4918.html#rfc.section.7.4
+func (s *Server) isParentLocked(path string, tokens []string) bool {
+	return !submitted(s.parentLocks(path), tokens)
+}
+
+// locks rooted at the collection containing path
+func (s *Server) parentLocks(path string) []*Lock {
+	if path == "/" {
+		return nil
+	}
+
+	parent := parentPath(path)
+
+	var locks []*Lock
+	for _, l := range s.Locks.Locks(parent) {
+		if l.Root == parent {
+			locks = append(locks, l)
+		}
+	}
+	return locks
 }
 
-// is path locked?
-func (s *Server) isLocked(path, ifHeader string) bool {
-	// TODO
+// is there no lock or was the token of one of them submitted?
+func submitted(locks []*Lock, tokens []string) bool {
+	if len(locks) == 0 {
+		return true
+	}
+
+	for _, t := range tokens {
+		for _, l := range locks {
+			if l.Token == t {
+				return true
+			}
+		}
+	}
+
 	return false
 }
 
-func (s *Server) lockResource(path string) {
-	// TODO
+// lockdiscovery property of path
+// http://www.webdav.org/specs/rfc4918.html#PROPERTY_lockdiscovery
+func (s *Server) lockDiscovery(path string) LockDiscovery {
+	var ld LockDiscovery
+	for _, l := range s.Locks.Locks(path) {
+		al := ActiveLock{
+			Write:     &struct{}{},
+			Depth:     "0",
+			Timeout:   l.timeoutString(),
+			LockToken: l.Token,
+			LockRoot:  s.href(l.Root, s.pathIsDirectory(l.Root)),
+		}
+		if l.Exclusive {
+			al.Exclusive = &struct{}{}
+		} else {
+			al.Shared = &struct{}{}
+		}
+		if l.Depth == InfiniteDepth {
+			al.Depth = "infinity"
+		}
+		if l.Owner != "" {
+			al.Owner = &Owner{InnerXML: l.Owner}
+		}
+
+		ld.ActiveLocks = append(ld.ActiveLocks, al)
+	}
+	return ld
 }
 
-func (s *Server) unlockResource(path string) {
-	// TODO
+// send the status of e, with an error body if it names the failed
+// preconditions or postconditions
+// http://www.webdav.org/specs/rfc4918.html#precondition.postcondition.xml.elements
+func (s *Server) writeError(w http.ResponseWriter, e *StatusError) {
+	if len(e.Conditions) == 0 {
+		w.WriteHeader(e.Status)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	writeXml(buf, &Error{Conditions: e.Conditions})
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(e.Status)
+	buf.WriteTo(w)
+}
+
+// hrefs of the roots of locks
+func (s *Server) lockHrefs(locks []*Lock) []string {
+	var hrefs []string
+	for _, l := range locks {
+		hrefs = append(hrefs, s.href(l.Root, s.pathIsDirectory(l.Root)))
+	}
+	return hrefs
+}
+
+// the resource at path, or the collection containing it, is locked and none
+// of its tokens was submitted
+// http://www.webdav.org/specs/rfc4918.html#precondition.postcondition.xml.elements
+func (s *Server) lockError(path string) *StatusError {
+	locks := s.Locks.Locks(path)
+	if len(locks) == 0 {
+		locks = s.parentLocks(path)
+	}
+	return NewStatusError(StatusLocked, davName("lock-token-submitted"), s.lockHrefs(locks)...)
+}
+
+// send a multistatus response with the status of each path
+func (s *Server) writeErrors(w http.ResponseWriter, r *http.Request, errors map[string]int) {
+	ms := NewMultiStatusWriter(w)
+	for p, e := range errors {
+		resp := Response{
+			Href:   []string{s.href(p, s.pathIsDirectory(p))},
+			Status: StatusLine(e),
+		}
+		if e == StatusLocked {
+			resp.Error = &Error{Conditions: s.lockError(p).Conditions}
+		}
+
+		if err := ms.Write(resp); err != nil {
+			return
+		}
+	}
+	ms.Close()
 }
 
 // The PROPFIND method retrieves properties defined on the resource identified by the Request-URI
@@ -187,225 +419,76 @@ func (s *Server) doPropfind(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	depth := r.Header.Get("Depth")
-	switch depth {
-	case "0", "1":
+	var depth int
+	switch r.Header.Get("Depth") {
+	case "0":
+		depth = 0
+	case "1":
+		depth = 1
 	case "", "infinity":
 		// treat as infinity if no depth header was included
-		// disable infinity for performance and security concerns
+		// disabled by default for performance and security concerns
 		// http://www.webdav.org/specs/rfc4918.html#rfc.section.9.1.1
-		w.WriteHeader(StatusForbidden)
-		return
+		if !s.AllowInfiniteDepth {
+			s.writeError(w, NewStatusError(StatusForbidden, davName("propfind-finite-depth")))
+			return
+		}
+		depth = InfiniteDepth
 	default:
 		w.WriteHeader(StatusBadRequest)
 		return
 	}
 
-	var propnames bool
-	var properties []string
-	var includes []string
-
-	if r.ContentLength > 0 {
-		propfind, err := NodeFromXml(r.Body)
-		if err != nil {
-			w.WriteHeader(StatusBadRequest)
-			return
-		}
-
-		if propfind.Name.Local != "propfind" {
-			w.WriteHeader(StatusBadRequest)
-			return
-		}
-
-		// find by property
-		// http://www.webdav.org/specs/rfc4918.html#dav.properties
-		if propfind.HasChildren("prop") {
-			prop := propfind.FirstChildren("prop")
-			for _, p := range prop.GetChildrens("*") {
-				properties = append(properties, p.Name.Local)
-			}
-		}
-
-		// find property names
-		if propfind.HasChildren("propname") {
-			propnames = true
-		}
-
-		// find all properties
-		if propfind.HasChildren("allprop") {
-			properties = []string{
-				"creationdate", "displayname",
-				"getcontentlanguage", "getcontentlength",
-				"getcontenttype", "getetag",
-				"getlastmodified", "lockdiscovery",
-				"resourcetype", "supportedlock",
-			}
-
-			if propfind.HasChildren("include") {
-				for _, i := range propfind.GetChildrens("include") {
-					includes = append(includes, i.Name.Local)
-				}
-			}
-		}
+	var pf PropFind
+	if err := newXmlDecoder(r.Body).Decode(&pf); err == io.EOF {
+		// an empty body is treated as allprop
+		pf.AllProp = &struct{}{}
+	} else if err != nil {
+		s.writeError(w, bodyError(err))
+		return
 	}
 
 	path := s.url2path(r.URL)
-	if !s.pathExists(path) {
+	fi, err := s.stat(path)
+	if err != nil {
 		http.Error(w, path, StatusNotFound)
 		// TODO: if locked (parent locked?) return multistatus with locked error as propstat
 		return
 	}
 
-	paths := []string{path}
-	if depth == "1" {
-		// fetch all files if directory
-		// TODO: respect []includes
-
-		if s.pathIsDirectory(path) {
-			for _, p := range s.directoryContents(path) {
-				paths = append(paths, path+"/"+p)
-			}
+	exceeded := s.walkLimit()
+
+	ms := NewMultiStatusWriter(w)
+	s.walkResponses(r.Context(), w, ms, path, fi, depth, func(p string, fi os.FileInfo) error {
+		// TODO: test authorization
+		if exceeded() {
+			// the client has to continue with lower depth from here
+			ms.Write(Response{
+				Href:                []string{s.href(p, fi.IsDir())},
+				Status:              StatusLine(StatusInsufficientStorage),
+				Error:               &Error{Conditions: []Condition{{XMLName: davName("propfind-finite-depth")}}},
+				ResponseDescription: "propfind limit reached",
+			})
+			return errStopWalk
 		}
-	}
 
-	buf := new(bytes.Buffer)
-	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
-	buf.WriteString(`<multistatus xmlns='DAV:'>`)
-
-	// TODO: https?
-	abs := "http://" + r.Host + s.TrimPrefix
-
-	for _, p := range paths {
-		// TODO
-		// test locks/ authorization
-		// if properties, show only given properties, else all
-		// if propnames, return names of properties, else names and values
-
-		propertiesNotFound := []string{}
-
-		f, _ := s.Fs.Open(p)
-		defer f.Close()
-		fi, _ := f.Stat()
-
-		buf.WriteString(`<response>`)
-		buf.WriteString(`<href>` + abs + p + `</href>`)
-		buf.WriteString(`<propstat>`)
-		{
-			buf.WriteString(`<prop>`)
-			{
-				//  TODO: make less ugly
-				for _, prop := range properties {
-
-					switch prop {
-					case "creationdate":
-						if propnames {
-							buf.WriteString(`<` + prop + `/>`)
-						} else {
-							buf.WriteString(`<` + prop + `>`)
-							buf.WriteString(fi.ModTime().Format("2006-01-02T15:04:05Z07:00"))
-							buf.WriteString(`</` + prop + `>`)
-						}
-					case "getcontentlanguage":
-						if propnames {
-							buf.WriteString(`<` + prop + `/>`)
-						} else {
-							buf.WriteString(`<` + prop + `>`)
-							buf.WriteString(`en`)
-							buf.WriteString(`</` + prop + `>`)
-						}
-					case "getcontentlength":
-						if fi.IsDir() {
-						} else if propnames {
-							buf.WriteString(`<` + prop + `/>`)
-						} else {
-							buf.WriteString(`<` + prop + `>`)
-							buf.WriteString(strconv.FormatInt(int64(fi.Size()), 10))
-							buf.WriteString(`</` + prop + `>`)
-						}
-					case "getcontenttype":
-						if fi.IsDir() {
-						} else if propnames {
-							buf.WriteString(`<` + prop + `/>`)
-						} else {
-							buf.WriteString(`<` + prop + `>`)
-							buf.WriteString(mime.TypeByExtension(filepath.Ext(fi.Name())))
-							buf.WriteString(`</` + prop + `>`)
-						}
-					case "getlastmodified":
-						if fi.IsDir() {
-						} else if propnames {
-							buf.WriteString(`<` + prop + `/>`)
-						} else {
-							buf.WriteString(`<` + prop + `>`)
-							buf.WriteString(fi.ModTime().Format("Mon, 02 Jan 2006 15:04:05 MST"))
-							buf.WriteString(`</` + prop + `>`)
-						}
-					case "resourcetype":
-						if propnames || !fi.IsDir() {
-							// ZODO: reson for all the ugliness
-							buf.WriteString(`<` + prop + `/>`)
-						} else {
-							buf.WriteString(`<` + prop + `>`)
-							buf.WriteString(`<collection/>`)
-							buf.WriteString(`</` + prop + `>`)
-						}
-					case "displayname":
-						if propnames {
-							buf.WriteString(`<` + prop + `/>`)
-						} else {
-							buf.WriteString(`<` + prop + `>`)
-							buf.WriteString(fi.Name())
-							buf.WriteString(`</` + prop + `>`)
-						}
-					case "supportedlock":
-						if propnames {
-							buf.WriteString(`<` + prop + `/>`)
-						} else {
-							buf.WriteString(`<` + prop + `>`)
-							buf.WriteString(`<lockentry><lockscope><exclusive/></lockscope><locktype><write/></locktype></lockentry>`)
-							buf.WriteString(`<lockentry><lockscope><shared/></lockscope><locktype><write/></locktype></lockentry>`)
-							buf.WriteString(`</` + prop + `>`)
-						}
-
-						// TODO: implement later at locks-stage
-						// case "getetag": // not for dir
-						// case "lockdiscovery":
-					default:
-						propertiesNotFound = append(propertiesNotFound, prop)
-					}
-				}
-			}
-			buf.WriteString(`</prop>`)
-			buf.WriteString(`<status>HTTP/1.1 200 OK</status>`)
-		}
-		buf.WriteString(`</propstat>`)
-
-		if len(propertiesNotFound) > 0 {
-			buf.WriteString(`<propstat>`)
-			{
-				buf.WriteString(`<prop>`)
-				{
-					for _, prop := range propertiesNotFound {
-						buf.WriteString(`<` + prop + `/>`)
-					}
-				}
-				buf.WriteString(`</prop>`)
-				buf.WriteString(`<status>HTTP/1.1 404 ` + StatusText(404) + `</status>`)
-			}
-			buf.WriteString(`</propstat>`)
-		}
+		return ms.Write(Response{
+			Href:     []string{s.href(p, fi.IsDir())},
+			Propstat: s.propfindPropstats(&pf, p, fi),
+		})
+	})
+}
 
-		buf.WriteString(`</response>`)
+// propstat elements of the resource at p requested by a PROPFIND
+func (s *Server) propfindPropstats(pf *PropFind, p string, fi os.FileInfo) []Propstat {
+	switch {
+	case pf.PropName != nil:
+		return s.propstats(p, fi, s.propertyNames(p, fi), false, true)
+	case pf.AllProp != nil:
+		return s.propstats(p, fi, append(s.propertyNames(p, fi), pf.Include...), true, true)
+	default:
+		return s.propstats(p, fi, pf.Prop, true, false)
 	}
-
-	buf.WriteString(`</multistatus>`)
-
-	w.WriteHeader(StatusMulti)
-	w.Header().Set("Content-Length", string(buf.Len()))
-	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-
-	buf.WriteTo(w)
-	// TODO: possible write error is suppressed
 }
 
 // http://www.webdav.org/specs/rfc4918.html#METHOD_PROPPATCH
@@ -415,13 +498,53 @@ func (s *Server) doProppatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if s.isLockedRequest(r) {
-		w.WriteHeader(StatusLocked)
+	path := s.url2path(r.URL)
+	if err := s.checkConditions(r, path); err != nil {
+		s.writeError(w, err)
 		return
 	}
 
-	// TODO: proppatch
-	w.WriteHeader(StatusNotImplemented)
+	if !s.pathExists(path) {
+		w.WriteHeader(StatusNotFound)
+		return
+	}
+
+	var pu PropertyUpdate
+	if err := newXmlDecoder(r.Body).Decode(&pu); err != nil {
+		s.writeError(w, bodyError(err))
+		return
+	}
+
+	status, err := s.patchProperties(path, pu.Instructions)
+	if err != nil {
+		s.writeError(w, statusError(err, onRead))
+		return
+	}
+
+	// group properties by status
+	byStatus := map[int]Prop{}
+	for n, code := range status {
+		byStatus[code] = append(byStatus[code], Property{Name: n})
+	}
+
+	// all or nothing
+	if len(byStatus[StatusOK]) == len(status) {
+		s.modified(path)
+	}
+
+	resp := Response{Href: []string{s.href(path, s.pathIsDirectory(path))}}
+	for code, props := range byStatus {
+		ps := Propstat{Prop: props, Status: StatusLine(code)}
+		if code == StatusForbidden {
+			ps.Error = &Error{Conditions: []Condition{{XMLName: davName("cannot-modify-protected-property")}}}
+		}
+		resp.Propstat = append(resp.Propstat, ps)
+	}
+
+	ms := NewMultiStatusWriter(w)
+	if err := ms.Write(resp); err == nil {
+		ms.Close()
+	}
 }
 
 // http://www.webdav.org/specs/rfc4918.html#METHOD_MKCOL
@@ -431,23 +554,28 @@ func (s *Server) doMkcol(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if s.isLockedRequest(r) {
-		w.WriteHeader(StatusLocked)
+	path := s.url2path(r.URL)
+	if err := s.checkConditions(r, path); err != nil {
+		s.writeError(w, err)
 		return
 	}
 
-	path := s.url2path(r.URL)
 	if s.pathExists(path) {
 		w.Header().Set("Allow", s.methodsAllowed(s.url2path(r.URL)))
 		w.WriteHeader(StatusMethodNotAllowed)
 		return
 	}
 
+	if s.isParentLocked(path, s.submittedTokens(r)) {
+		s.writeError(w, s.lockError(path))
+		return
+	}
+
 	// MKCOL may contain messagebody, precise behavior is undefined
 	if r.ContentLength > 0 {
 		_, err := NodeFromXml(r.Body)
 		if err != nil {
-			w.WriteHeader(StatusBadRequest)
+			s.writeError(w, bodyError(err))
 			return
 		}
 
@@ -455,13 +583,13 @@ func (s *Server) doMkcol(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.Fs.Mkdir(path); err != nil {
-		w.WriteHeader(StatusConflict)
+	if err := s.mkdir(r.Context(), path); err != nil {
+		s.writeError(w, statusError(err, onCreate))
 		return
 	}
+	s.modified(path)
 
 	w.WriteHeader(StatusCreated)
-	s.unlockResource(path)
 }
 
 // http://www.webdav.org/specs/rfc4918.html#rfc.section.9.4
@@ -482,9 +610,9 @@ func (s *Server) doPost(w http.ResponseWriter, r *http.Request) {
 func (s *Server) serveResource(w http.ResponseWriter, r *http.Request, serveContent bool) {
 	path := s.url2path(r.URL)
 
-	f, err := s.Fs.Open(path)
+	f, err := s.open(r.Context(), path)
 	if err != nil {
-		http.Error(w, r.RequestURI, StatusNotFound)
+		s.writeError(w, statusError(err, onRead))
 		return
 	}
 	defer f.Close()
@@ -493,11 +621,19 @@ func (s *Server) serveResource(w http.ResponseWriter, r *http.Request, serveCont
 
 	fi, err := f.Stat()
 	if err != nil {
-		http.Error(w, r.RequestURI, StatusNotFound)
+		s.writeError(w, statusError(err, onRead))
 		return
 	}
 	modTime := fi.ModTime()
 
+	// ServeContent evaluates conditional requests against it
+	if etag := s.etagOf(path, fi); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !fi.IsDir() {
+		s.setDigestHeaders(w, path)
+	}
+
 	if serveContent {
 		http.ServeContent(w, r, path, modTime, f)
 	} else {
@@ -513,96 +649,117 @@ func (s *Server) doDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if s.isLockedRequest(r) {
-		w.WriteHeader(StatusLocked)
+	path := s.url2path(r.URL)
+	if err := s.checkConditions(r, path); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if s.isParentLocked(path, s.submittedTokens(r)) {
+		s.writeError(w, s.lockError(path))
 		return
 	}
 
-	s.deleteResource(s.url2path(r.URL), w, r, true)
-}
+	errors := map[string]int{}
+	status := s.deleteResource(path, r, errors)
+	if len(errors) != 0 {
+		s.writeErrors(w, r, errors)
+		return
+	}
 
-func (s *Server) deleteResource(path string, w http.ResponseWriter, r *http.Request, setStatus bool) bool {
-	ifHeader := r.Header.Get("If")
-	lockToken := r.Header.Get("Lock-Token")
+	s.writeStatus(w, status, path)
+}
 
-	if s.isLocked(path, ifHeader+lockToken) {
-		w.WriteHeader(StatusLocked)
-		return false
+// delete the resource at path, failures of collection members are collected
+// in errors. Returns the status of the whole operation, 204 on success.
+func (s *Server) deleteResource(path string, r *http.Request, errors map[string]int) int {
+	if s.isLocked(path, s.submittedTokens(r)) {
+		return StatusLocked
 	}
 
-	if !s.pathExists(path) {
-		w.WriteHeader(StatusNotFound)
-		return false
+	fi, err := s.stat(path)
+	if err != nil {
+		return StatusNotFound
 	}
 
-	if !s.pathIsDirectory(path) {
-		if err := s.Fs.Remove(path); err != nil {
-			w.WriteHeader(StatusInternalServerError)
-			return false
+	if !fi.IsDir() {
+		if err := s.remove(r.Context(), path); err != nil {
+			return errorStatus(err, onRead)
 		}
+		s.deleteProperties(path)
+		s.removed(path)
+		s.grew(-fi.Size())
 	} else {
 		// http://www.webdav.org/specs/rfc4918.html#delete-collections
-		errors := map[string]int{}
-		s.deleteCollection(path, w, r, errors)
-
-		if err := s.Fs.Remove(path); err != nil {
-			errors[path] = StatusInternalServerError
+		failed := len(errors)
+		s.deleteCollection(path, r, errors)
+		s.resized()
+
+		if len(errors) != failed {
+			// the collection itself can not be removed
+			s.modified(path)
+			return StatusMulti
+		}
+		if status := contextStatus(r.Context()); status != 0 {
+			// stopped, remaining members are kept
+			s.modified(path)
+			return status
 		}
 
-		if len(errors) != 0 {
-			// send multistatus
-			abs := r.RequestURI
-
-			buf := new(bytes.Buffer)
-			buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
-			buf.WriteString(`<multistatus xmlns='DAV:'>`)
-
-			for p, e := range errors {
-				buf.WriteString(`<response>`)
-				buf.WriteString(`<href>` + abs + p + `</href>`)
-				buf.WriteString(`<status>HTTP/1.1 ` + string(e) + ` ` + StatusText(e) + `</status>`)
-				buf.WriteString(`</response>`)
-			}
-
-			buf.WriteString(`</multistatus>`)
-
-			w.WriteHeader(StatusMulti)
-			w.Header().Set("Content-Length", string(buf.Len()))
-			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-			buf.WriteTo(w)
-
-			return false
+		if err := s.remove(r.Context(), path); err != nil {
+			errors[path] = errorStatus(err, onRead)
+			s.modified(path)
+			return StatusMulti
 		}
+		s.deleteProperties(path)
+		s.removed(path)
 	}
 
-	if setStatus {
-		w.WriteHeader(StatusNoContent)
-	}
-	return true
+	// locks are removed together with the resource
+	s.Locks.Remove(path)
+
+	return StatusNoContent
 }
 
-func (s *Server) deleteCollection(path string, w http.ResponseWriter, r *http.Request, errors map[string]int) {
-	ifHeader := r.Header.Get("If")
-	lockToken := r.Header.Get("Lock-Token")
+func (s *Server) deleteCollection(path string, r *http.Request, errors map[string]int) {
+	tokens := s.submittedTokens(r)
 
-	for _, p := range s.directoryContents(path) {
-		p = path + "/" + p
+	for _, p := range s.directoryContents(r.Context(), path) {
+		if r.Context().Err() != nil {
+			return
+		}
+		p = joinPath(path, p)
 
-		if s.isLocked(p, ifHeader+lockToken) {
+		if s.isLocked(p, tokens) {
 			errors[p] = StatusLocked
 		} else {
 			if s.pathIsDirectory(p) {
-				s.deleteCollection(p, w, r, errors)
+				s.deleteCollection(p, r, errors)
 			}
 
-			if err := s.Fs.Remove(p); err != nil {
-				errors[p] = StatusInternalServerError
+			if err := s.remove(r.Context(), p); err != nil {
+				// not reported if a member failed before or the request was stopped
+				if !s.failedBelow(p, errors) && r.Context().Err() == nil {
+					errors[p] = errorStatus(err, onRead)
+				}
+			} else {
+				s.deleteProperties(p)
 			}
 		}
 	}
 
 }
 
+// did a member of the collection p fail?
+func (s *Server) failedBelow(p string, errors map[string]int) bool {
+	for e := range errors {
+		if isDescendant(p, e) {
+			return true
+		}
+	}
+	return false
+}
+
 // http://www.webdav.org/specs/rfc4918.html#METHOD_PUT
 func (s *Server) doPut(w http.ResponseWriter, r *http.Request) {
 	if s.ReadOnly {
@@ -610,42 +767,114 @@ func (s *Server) doPut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if s.isLockedRequest(r) {
-		w.WriteHeader(StatusLocked)
+	path := s.url2path(r.URL)
+	if err := s.checkConditions(r, path); err != nil {
+		s.writeError(w, err)
 		return
 	}
 
-	path := s.url2path(r.URL)
-
 	if s.pathIsDirectory(path) {
 		// use MKCOL instead
 		w.WriteHeader(StatusMethodNotAllowed)
 		return
 	}
 
-	exists := s.pathExists(path)
+	// a new file is added to its collection
+	if !s.pathExists(path) && s.isParentLocked(path, s.submittedTokens(r)) {
+		s.writeError(w, s.lockError(path))
+		return
+	}
+
+	// partial update, http://tools.ietf.org/html/rfc7231#section-4.3.4
+	if r.Header.Get("Content-Range") != "" {
+		s.putRange(w, r, path)
+		return
+	}
+
+	var oldSize int64
+	perm := os.FileMode(0666)
+	fi, err := s.stat(path)
+	exists := err == nil
+	if exists {
+		oldSize = fi.Size()
+		perm = fi.Mode().Perm()
+	}
 
-	// TODO: content range / partial put
+	// bytes left for the new content, http://tools.ietf.org/html/rfc4331#section-6
+	var remaining int64
+	limited := s.QuotaLimit > 0
+	if limited {
+		remaining = s.QuotaLimit - s.usedBytes() + oldSize
+		if remaining < 0 || r.ContentLength > remaining {
+			s.writeError(w, NewStatusError(StatusInsufficientStorage, davName("quota-not-exceeded")))
+			return
+		}
+	}
 
-	// truncate file if exists
-	file, err := s.Fs.Create(path)
+	digests, err := newDigester(r.Header)
 	if err != nil {
-		w.WriteHeader(StatusConflict)
+		w.WriteHeader(StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	if _, err := io.Copy(file, r.Body); err != nil {
-		w.WriteHeader(StatusConflict)
-	} else {
-		if exists {
-			w.WriteHeader(StatusNoContent)
-		} else {
-			w.WriteHeader(StatusCreated)
-		}
+	// the previous version is only kept on a mismatch if the content goes to a temporary file
+	if _, ok := s.Fs.(Renamer); !ok && digests.verifying() {
+		w.WriteHeader(StatusNotImplemented)
+		return
 	}
 
-	s.unlockResource(path)
+	// written to a temporary file, readers see the old content until it is complete
+	file, err := s.startUpload(r.Context(), path, perm)
+	if err != nil {
+		s.writeError(w, statusError(err, onCreate))
+		return
+	}
+
+	body := io.Reader(contextReader{r.Context(), r.Body})
+	if limited {
+		// the length of chunked bodies is not known in advance
+		body = io.LimitReader(body, remaining+1)
+	}
+
+	n, err := io.Copy(file, io.TeeReader(body, digests))
+	if err != nil {
+		file.failed(exists)
+		s.writeError(w, statusError(err, onCreate))
+		return
+	}
+
+	if limited && n > remaining {
+		file.failed(exists)
+		s.writeError(w, NewStatusError(StatusInsufficientStorage, davName("quota-not-exceeded")))
+		return
+	}
+
+	// the previous version is kept
+	if !digests.verify() {
+		file.failed(exists)
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	if err := file.commit(); err != nil {
+		file.failed(exists)
+		s.writeError(w, statusError(err, onCreate))
+		return
+	}
+	s.recordChecksums(path, digests)
+
+	s.modified(path)
+	s.grew(n - oldSize)
+
+	if etag := s.etag(path); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if exists {
+		w.WriteHeader(StatusNoContent)
+	} else {
+		w.WriteHeader(StatusCreated)
+	}
 }
 
 // http://www.webdav.org/specs/rfc4918.html#METHOD_COPY
@@ -655,7 +884,26 @@ func (s *Server) doCopy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.copyResource(w, r)
+	if err := s.checkConditions(r); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	source := s.url2path(r.URL)
+	dest, status := s.destination(r, source)
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	errors := map[string]int{}
+	status = s.copyResource(source, dest, r.Header.Get("Depth") != "0", r, errors)
+	if len(errors) != 0 {
+		s.writeErrors(w, r, errors)
+		return
+	}
+
+	s.writeStatus(w, status, dest)
 }
 
 // http://www.webdav.org/specs/rfc4918.html#METHOD_MOVE
@@ -665,216 +913,577 @@ func (s *Server) doMove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if s.isLockedRequest(r) {
-		w.WriteHeader(StatusLocked)
+	source := s.url2path(r.URL)
+	if err := s.checkConditions(r, source); err != nil {
+		s.writeError(w, err)
 		return
 	}
 
-	if s.copyResource(w, r) {
-		// TODO: duplicate http-header sent?
-		s.deleteResource(s.url2path(r.URL), w, r, false)
+	dest, status := s.destination(r, source)
+	if status != 0 {
+		w.WriteHeader(status)
+		return
 	}
-}
 
-func (s *Server) copyResource(w http.ResponseWriter, r *http.Request) bool {
-	dest := r.Header.Get("Destination")
-	if dest == "" {
+	// a collection is always moved with its members
+	// http://www.webdav.org/specs/rfc4918.html#move-collections
+	if d := r.Header.Get("Depth"); d != "" && d != "infinity" {
 		w.WriteHeader(StatusBadRequest)
-		return false
+		return
 	}
 
-	d, err := url.Parse(dest)
-	if err != nil {
-		w.WriteHeader(StatusBadRequest)
-		return false
+	// source is removed from its collection
+	if s.isParentLocked(source, s.submittedTokens(r)) {
+		s.writeError(w, s.lockError(source))
+		return
 	}
-	// TODO: normalize dest?
-	dest = s.url2path(d)
-	source := s.url2path(r.URL)
 
-	// source equals destination
-	if source == dest {
-		w.WriteHeader(StatusForbidden)
-		return false
+	// members are moved too, none of them may be locked by others
+	if locks := s.lockedBelow(source, s.submittedTokens(r)); len(locks) != 0 {
+		s.writeError(w, NewStatusError(StatusLocked, davName("lock-token-submitted"), s.lockHrefs(locks)...))
+		return
+	}
+
+	errors := map[string]int{}
+	status = s.moveResource(source, dest, r, errors)
+	if len(errors) != 0 {
+		s.writeErrors(w, r, errors)
+		return
+	}
+
+	s.writeStatus(w, status, dest)
+}
+
+// send status, 207 is only used for multistatus bodies.
+// A 423 refers to the locked resource at path.
+func (s *Server) writeStatus(w http.ResponseWriter, status int, path string) {
+	switch status {
+	case StatusInsufficientStorage:
+		s.writeError(w, NewStatusError(status, davName("quota-not-exceeded")))
+	case StatusLocked:
+		s.writeError(w, s.lockError(path))
+	default:
+		w.WriteHeader(status)
+	}
+}
+
+// path of the Destination header of COPY and MOVE requests, or the status to fail with
+// http://www.webdav.org/specs/rfc4918.html#HEADER_Destination
+func (s *Server) destination(r *http.Request, source string) (string, int) {
+	h := r.Header.Get("Destination")
+	if h == "" {
+		return "", StatusBadRequest
+	}
+
+	d, err := parseDestination(h)
+	if err != nil {
+		return "", StatusBadRequest
 	}
 
 	// destination must be same server/namespace as source
-	if d.Host != r.Host ||
-		!strings.HasPrefix(d.Path, s.TrimPrefix) ||
-		!strings.HasPrefix(r.URL.Path, s.TrimPrefix) {
+	if (d.Host != "" && d.Host != r.Host) || !s.inNamespace(d) {
+		return "", StatusBadGateway
+	}
 
-		w.WriteHeader(StatusBadGateway)
-		return false
+	dest := s.url2path(d)
+
+	// internal files of the server can not be written by clients
+	if s.hiddenPath(dest) || s.isUpload(dest) {
+		return "", StatusForbidden
+	}
+
+	// source equals destination, or a collection into itself
+	if source == dest || isDescendant(source, dest) {
+		return "", StatusForbidden
 	}
 
-	// TODO: needs to be tested? should be catched with error at CopyFile returning StatusConflict
-	// currently only at depth=0 or non-collection copy
-	/*
-		parentDest := dest[:strings.LastIndex(dest, "/")]
-		if !s.pathExists(parentDest) {
-			w.WriteHeader(StatusConflict)
-			return false
+	return dest, 0
+}
+
+// locks of members of the collection p whose tokens were not submitted
+func (s *Server) lockedBelow(p string, tokens []string) []*Lock {
+	var locked []*Lock
+	for _, l := range s.Locks.Below(p) {
+		submitted := false
+		for _, t := range tokens {
+			if t == l.Token {
+				submitted = true
+				break
+			}
 		}
-	*/
 
+		if !submitted {
+			locked = append(locked, l)
+		}
+	}
+	return locked
+}
+
+// prepare dest to be replaced, the status to fail with is returned
+func (s *Server) prepareDestination(dest string, overwrite bool, r *http.Request, errors map[string]int) (exists bool, status int) {
+	tokens := s.submittedTokens(r)
+	if s.isLocked(dest, tokens) || s.isParentLocked(dest, tokens) {
+		return false, StatusLocked
+	}
+
+	exists = s.pathExists(dest)
+	if !exists {
+		// http://www.webdav.org/specs/rfc4918.html#rfc.section.9.8.5
+		if !s.pathIsDirectory(parentPath(dest)) {
+			return false, StatusConflict
+		}
+		return false, 0
+	}
+
+	if !overwrite {
+		return true, StatusPreconditionFailed
+	}
+
+	// replaced resources are deleted first
+	// http://www.webdav.org/specs/rfc4918.html#HEADER_Overwrite
+	if status := s.deleteResource(dest, r, errors); status != StatusNoContent {
+		return true, status
+	}
+	return true, 0
+}
+
+// copy source to dest, its members too if recursive. Failures of members are
+// collected in errors. Returns the status of the whole operation, 201 or 204 on success.
+func (s *Server) copyResource(source, dest string, recursive bool, r *http.Request, errors map[string]int) int {
 	overwrite := r.Header.Get("Overwrite") != "F"
-	exists := s.pathExists(dest)
 
-	if overwrite {
-		if exists {
-			if !s.deleteResource(dest, w, r, false) {
-				w.WriteHeader(StatusInternalServerError)
-				return false
-			}
+	// replaced files are freed
+	size := int64(-1)
+	if s.QuotaLimit > 0 {
+		size = s.treeSize(source)
+		need := size
+		if overwrite && s.pathExists(dest) {
+			need -= s.treeSize(dest)
 		}
-	} else {
-		if exists {
-			w.WriteHeader(StatusPreconditionFailed)
-			return false
+
+		if !s.quotaAllows(need) {
+			return StatusInsufficientStorage
 		}
 	}
 
+	if !s.pathExists(source) {
+		return StatusNotFound
+	}
+
+	exists, status := s.prepareDestination(dest, overwrite, r, errors)
+	if status != 0 {
+		return status
+	}
+
+	// the usage grows by the size of source, if it is known and all was copied
+	copied := false
+	defer func() {
+		if copied && size >= 0 {
+			s.grew(size)
+		} else {
+			s.resized()
+		}
+	}()
+
 	if !s.pathIsDirectory(source) {
-		if err := s.CopyFile(source, dest); err != nil {
-			// TODO: always conflict? e.g. copy to non-existant path
-			//w.WriteHeader(StatusInternalServerError)
-			w.WriteHeader(StatusConflict)
-			return false
-		}
-	} else if r.Header.Get("Depth") == "0" {
-		// copy only collection, not its internal members
-		// http://www.webdav.org/specs/rfc4918.html#copy.for.collections
-		if err := s.Fs.Mkdir(dest); err != nil {
-			w.WriteHeader(StatusConflict)
-			return false
+		if err := s.copyFile(r.Context(), source, dest); err != nil {
+			return errorStatus(err, onDestination)
+		}
+
+		if err := s.Props.Copy(source, dest); err != nil {
+			return errorStatus(err, onDestination)
 		}
 	} else {
 		// http://www.webdav.org/specs/rfc4918.html#copy.for.collections
-		errors := map[string]int{}
+		if err := s.mkdir(r.Context(), dest); err != nil {
+			return errorStatus(err, onDestination)
+		}
+
+		if err := s.Props.Copy(source, dest); err != nil {
+			return errorStatus(err, onDestination)
+		}
+
+		if recursive {
+			failed := len(errors)
+			s.copyCollection(source, dest, r, errors)
 
-		if err := s.Fs.Mkdir(dest); err != nil {
-			errors[source] = StatusInternalServerError
+			if len(errors) != failed {
+				s.modified(dest)
+				return StatusMulti
+			}
+			if status := contextStatus(r.Context()); status != 0 {
+				// stopped, the copy is incomplete
+				s.modified(dest)
+				return status
+			}
 		}
+	}
 
-		s.copyCollection(source, dest, w, r, errors)
+	// copy was successful
+	copied = true
+	s.modified(dest)
+
+	if exists {
+		return StatusNoContent
+	}
+	return StatusCreated
+}
 
-		if len(errors) != 0 {
-			// send multistatus
-			abs := r.RequestURI
+// move source to dest, by renaming it if the FileSystem is a Renamer.
+// Otherwise source is copied and deleted, failures of members are collected
+// in errors. Returns the status of the whole operation, 201 or 204 on success.
+func (s *Server) moveResource(source, dest string, r *http.Request, errors map[string]int) int {
+	if _, ok := s.Fs.(Renamer); ok {
+		if status, ok := s.renameResource(source, dest, r, errors); ok {
+			return status
+		}
+	}
 
-			buf := new(bytes.Buffer)
-			buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
-			buf.WriteString(`<multistatus xmlns='DAV:'>`)
+	status := s.copyResource(source, dest, true, r, errors)
+	if status != StatusCreated && status != StatusNoContent {
+		// source is kept
+		return status
+	}
 
-			for p, e := range errors {
-				buf.WriteString(`<response>`)
-				buf.WriteString(`<href>` + abs + p + `</href>`)
-				buf.WriteString(`<status>HTTP/1.1 ` + string(e) + ` ` + StatusText(e) + `</status>`)
-				buf.WriteString(`</response>`)
+	if st := s.deleteResource(source, r, errors); st != StatusNoContent {
+		if st != StatusMulti {
+			errors[source] = st
+		}
+		return StatusMulti
+	}
+	return status
+}
+
+// move source to dest with a single rename, false if it has to be copied,
+// e.g. to another device. A replaced file is overwritten by the rename itself,
+// a replaced collection is moved aside and deleted once source took its place,
+// so dest is kept if the move fails.
+func (s *Server) renameResource(source, dest string, r *http.Request, errors map[string]int) (int, bool) {
+	sfi, err := s.stat(source)
+	if err != nil {
+		return StatusNotFound, true
+	}
+
+	tokens := s.submittedTokens(r)
+	if s.isLocked(dest, tokens) || s.isParentLocked(dest, tokens) {
+		return StatusLocked, true
+	}
+
+	dfi, err := s.stat(dest)
+	exists := err == nil
+	switch {
+	case !exists && !s.pathIsDirectory(parentPath(dest)):
+		// http://www.webdav.org/specs/rfc4918.html#rfc.section.9.9.4
+		return StatusConflict, true
+	case exists && r.Header.Get("Overwrite") == "F":
+		return StatusPreconditionFailed, true
+	}
+
+	if exists {
+		// members of the replaced collection are deleted, none of them may be locked by others
+		if locks := s.lockedBelow(dest, tokens); len(locks) != 0 {
+			for _, l := range locks {
+				errors[l.Root] = StatusLocked
 			}
+			return StatusMulti, true
+		}
+	}
 
-			buf.WriteString(`</multistatus>`)
+	var aside string
+	if exists && (sfi.IsDir() || dfi.IsDir()) {
+		if aside, err = tempPath(dest); err != nil {
+			return StatusInternalServerError, true
+		}
+		if err := s.renameWithProperties(dest, aside); err != nil {
+			return errorStatus(err, onDestination), true
+		}
+	}
 
-			w.WriteHeader(StatusMulti)
-			w.Header().Set("Content-Length", string(buf.Len()))
-			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-			buf.WriteTo(w)
+	if err := s.rename(source, dest); err != nil {
+		if aside != "" {
+			if err := s.renameWithProperties(aside, dest); err != nil {
+				log.Println("DAV:", "restoring replaced resource failed", dest, aside, err)
+			}
+		}
 
-			return false
+		if isCrossDevice(err) {
+			return 0, false
 		}
+		return errorStatus(err, onDestination), true
 	}
 
-	// copy was successful
+	if aside != "" {
+		if err := s.removeTree(aside); err != nil {
+			log.Println("DAV:", "removing replaced resource failed", aside, err)
+		}
+		s.resized()
+	} else if exists {
+		// overwritten by the rename
+		s.grew(-dfi.Size())
+	}
+
+	// locks are not moved, http://www.webdav.org/specs/rfc4918.html#rfc.section.7.7
+	// and those of the replaced resource are gone with it
+	s.Locks.Remove(dest)
+	s.Locks.Remove(source)
+
+	if err := s.Props.Move(source, dest); err != nil {
+		log.Println("DAV:", "moving properties failed", source, dest, err)
+	}
+
+	s.removed(source)
 	if exists {
-		w.WriteHeader(StatusNoContent)
-	} else {
-		w.WriteHeader(StatusCreated)
+		// the change counters of the replaced members are dropped
+		s.removed(dest)
 	}
+	s.movedTree(dest)
 
-	s.unlockResource(dest)
-	return true
+	if exists {
+		return StatusNoContent, true
+	}
+	return StatusCreated, true
+}
+
+// rename oldpath to newpath together with its dead properties
+func (s *Server) renameWithProperties(oldpath, newpath string) error {
+	if err := s.rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	if err := s.Props.Move(oldpath, newpath); err != nil {
+		log.Println("DAV:", "moving properties failed", oldpath, newpath, err)
+	}
+	return nil
+}
+
+// record the members of a moved collection as changed
+func (s *Server) movedTree(dest string) {
+	fi, err := s.stat(dest)
+	if err != nil {
+		return
+	}
+
+	s.walk(context.Background(), dest, fi, InfiniteDepth, func(p string, fi os.FileInfo) error {
+		s.modified(p)
+		return nil
+	})
 }
 
 func (s *Server) CopyFile(source, dest string) error {
+	return s.copyFile(context.Background(), source, dest)
+}
+
+// copy the file source to dest, stopped once ctx is done
+func (s *Server) copyFile(ctx context.Context, source, dest string) error {
 	// open source file
-	fs, err := s.Fs.Open(source)
+	fs, err := s.open(ctx, source)
 	if err != nil {
 		return err
 	}
 	defer fs.Close()
 
-	// open destination file
-	fd, err := s.Fs.Create(dest)
+	fi, err := fs.Stat()
+	if err != nil {
+		return err
+	}
+
+	// open destination file with the permissions of source
+	fd, err := s.openFile(ctx, dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
 
 	// copy file contents
-	if _, err := io.Copy(fd, fs); err != nil {
+	if _, err := io.Copy(fd, contextReader{ctx, fs}); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
 		return err
 	}
 
-	// TODO: copy file stats? http://www.webdav.org/specs/rfc4918.html#copy.for.properties
+	// keep the modification time, http://www.webdav.org/specs/rfc4918.html#copy.for.properties
+	if err := s.chtimes(dest, time.Now(), fi.ModTime()); err != nil && err != ErrNotImplemented {
+		return err
+	}
 
 	return nil
 }
 
-func (s *Server) copyCollection(source, dest string, w http.ResponseWriter, r *http.Request, errors map[string]int) {
-	ifHeader := r.Header.Get("If")
-	lockToken := r.Header.Get("Lock-Token")
+func (s *Server) copyCollection(source, dest string, r *http.Request, errors map[string]int) {
+	tokens := s.submittedTokens(r)
 
-	for _, sub := range s.directoryContents(source) {
-		ssub := source + "/" + sub
-		dsub := dest + "/" + sub
+	for _, sub := range s.directoryContents(r.Context(), source) {
+		if r.Context().Err() != nil {
+			return
+		}
+		ssub := joinPath(source, sub)
+		dsub := joinPath(dest, sub)
 
-		if s.isLocked(ssub, ifHeader+lockToken) {
-			errors[ssub] = StatusLocked
+		// locks of the source do not matter, it is not changed
+		if s.isLocked(dsub, tokens) {
+			errors[dsub] = StatusLocked
 		} else {
 			if s.pathIsDirectory(ssub) {
-				if err := s.Fs.Mkdir(dsub); err != nil {
-					errors[ssub] = StatusInternalServerError
+				if err := s.mkdir(r.Context(), dsub); err != nil {
+					errors[ssub] = errorStatus(err, onDestination)
 				}
 
-				s.copyCollection(ssub, dsub, w, r, errors)
+				s.copyCollection(ssub, dsub, r, errors)
 			} else {
-				if err := s.CopyFile(ssub, dsub); err != nil {
-					errors[ssub] = StatusInternalServerError
+				if err := s.copyFile(r.Context(), ssub, dsub); err != nil {
+					errors[ssub] = errorStatus(err, onDestination)
 				}
 			}
+
+			if r.Context().Err() != nil {
+				// stopped, not a failure of the member
+				delete(errors, ssub)
+				return
+			}
+
+			if _, failed := errors[ssub]; !failed {
+				if err := s.Props.Copy(ssub, dsub); err != nil {
+					errors[ssub] = errorStatus(err, onDestination)
+				}
+				s.modified(dsub)
+			}
 		}
 	}
 
 }
 
+// http://www.webdav.org/specs/rfc4918.html#METHOD_LOCK
 func (s *Server) doLock(w http.ResponseWriter, r *http.Request) {
 	if s.ReadOnly {
 		w.WriteHeader(StatusForbidden)
 		return
 	}
 
-	if s.isLockedRequest(r) {
-		w.WriteHeader(StatusLocked)
+	path := s.url2path(r.URL)
+	timeout := parseTimeout(r.Header.Get("Timeout"))
+
+	// locks are tested by the lock manager itself
+	if err := s.checkConditions(r); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var li LockInfo
+	err := newXmlDecoder(r.Body).Decode(&li)
+	if err == io.EOF {
+		// refreshing locks, http://www.webdav.org/specs/rfc4918.html#refreshing-locks
+		l, err := s.Locks.Refresh(path, s.submittedTokens(r), timeout)
+		if err != nil {
+			w.WriteHeader(StatusPreconditionFailed)
+			return
+		}
+
+		s.writeLock(w, path, l, StatusOK)
+		return
+	} else if err != nil {
+		s.writeError(w, bodyError(err))
+		return
+	} else if (li.Exclusive == nil) == (li.Shared == nil) || li.Write == nil {
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	var owner string
+	if li.Owner != nil {
+		owner = li.Owner.InnerXML
+	}
+
+	depth := InfiniteDepth
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		depth = 0
+	default:
+		w.WriteHeader(StatusBadRequest)
+		return
+	}
+
+	// locking an unmapped url adds a member to its collection
+	if !s.pathExists(path) && s.isParentLocked(path, s.submittedTokens(r)) {
+		s.writeError(w, s.lockError(path))
+		return
+	}
+
+	l, err := s.Locks.Lock(path, depth, li.Exclusive != nil, owner, timeout)
+	if err != nil {
+		if err == ErrLocked {
+			conflicts := s.Locks.Locks(path)
+			if depth == InfiniteDepth {
+				conflicts = append(conflicts, s.Locks.Below(path)...)
+			}
+			s.writeError(w, NewStatusError(StatusLocked, davName("no-conflicting-lock"), s.lockHrefs(conflicts)...))
+		} else {
+			w.WriteHeader(StatusInternalServerError)
+		}
+		return
+	}
+
+	// locking an unmapped url creates an empty resource
+	// http://www.webdav.org/specs/rfc4918.html#lock-unmapped-urls
+	status := StatusOK
+	if !s.pathExists(path) {
+		f, err := s.create(r.Context(), path)
+		if err != nil {
+			s.Locks.Unlock(path, l.Token)
+			s.writeError(w, statusError(err, onCreate))
+			return
+		}
+		f.Close()
+		s.modified(path)
+
+		status = StatusCreated
+	}
+
+	w.Header().Set("Lock-Token", "<"+l.Token+">")
+	s.writeLock(w, path, l, status)
+}
+
+// send the lockdiscovery of a created or refreshed lock
+func (s *Server) writeLock(w http.ResponseWriter, path string, l *Lock, status int) {
+	v := struct {
+		XMLName       xml.Name `xml:"DAV: prop"`
+		LockDiscovery LockDiscovery
+	}{LockDiscovery: s.lockDiscovery(path)}
+
+	buf := new(bytes.Buffer)
+	if err := writeXml(buf, v); err != nil {
+		w.WriteHeader(StatusInternalServerError)
 		return
 	}
 
-	// TODO: lock
-	w.WriteHeader(StatusNotImplemented)
+	w.Header().Set("Timeout", l.timeoutString())
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+
+	buf.WriteTo(w)
 }
 
+// http://www.webdav.org/specs/rfc4918.html#METHOD_UNLOCK
 func (s *Server) doUnlock(w http.ResponseWriter, r *http.Request) {
 	if s.ReadOnly {
 		w.WriteHeader(StatusForbidden)
 		return
 	}
 
-	if s.isLockedRequest(r) {
-		w.WriteHeader(StatusLocked)
+	token := strings.TrimSpace(r.Header.Get("Lock-Token"))
+	if !strings.HasPrefix(token, "<") || !strings.HasSuffix(token, ">") {
+		w.WriteHeader(StatusBadRequest)
 		return
 	}
+	token = token[1 : len(token)-1]
 
-	// TODO: unlock
-	w.WriteHeader(StatusNotImplemented)
+	if err := s.Locks.Unlock(s.url2path(r.URL), token); err != nil {
+		s.writeError(w, NewStatusError(StatusConflict, davName("lock-token-matches-request-uri")))
+		return
+	}
+
+	w.WriteHeader(StatusNoContent)
 }
 
 func (s *Server) doOptions(w http.ResponseWriter, r *http.Request) {
@@ -882,5 +1491,8 @@ func (s *Server) doOptions(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("DAV", "1, 2")
 
 	w.Header().Set("Allow", s.methodsAllowed(s.url2path(r.URL)))
+	if _, ok := s.Fs.(OpenFiler); ok {
+		w.Header().Set("Accept-Patch", partialUpdateType)
+	}
 	w.Header().Set("MS-Author-Via", "DAV")
 }
@@ -0,0 +1,206 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// name prefix of sidecar files
+const sidecarPrefix = ".davprops."
+
+// A SidecarPropertyStore keeps the dead properties of a resource in a hidden
+// file next to it, e.g. /dir/.davprops.file for /dir/file. The sidecar files
+// are accessed through the FileSystem itself, so any implementation can be used.
+type SidecarPropertyStore struct {
+	Fs FileSystem
+
+	mu sync.Mutex
+}
+
+func NewSidecarPropertyStore(fs FileSystem) *SidecarPropertyStore {
+	return &SidecarPropertyStore{Fs: fs}
+}
+
+// serialized sidecar file
+type sidecarFile struct {
+	XMLName xml.Name          `xml:"properties"`
+	Props   []sidecarProperty `xml:"property"`
+}
+
+type sidecarProperty struct {
+	Space string `xml:"space,attr"`
+	Local string `xml:"local,attr"`
+	Lang  string `xml:"lang,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// Hidden reports whether name is a sidecar file.
+func (s *SidecarPropertyStore) Hidden(name string) bool {
+	return strings.HasPrefix(path.Base(name), sidecarPrefix)
+}
+
+// name of the sidecar file of path
+func (s *SidecarPropertyStore) sidecar(p string) string {
+	dir, base := path.Split(cleanPath(p))
+	return dir + sidecarPrefix + base
+}
+
+func (s *SidecarPropertyStore) read(p string) (map[xml.Name]Property, error) {
+	ret := map[xml.Name]Property{}
+
+	f, err := s.Fs.Open(s.sidecar(p))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var sf sidecarFile
+	if err := xml.NewDecoder(f).Decode(&sf); err != nil {
+		return nil, err
+	}
+
+	for _, sp := range sf.Props {
+		n := xml.Name{Space: sp.Space, Local: sp.Local}
+		ret[n] = Property{Name: n, Lang: sp.Lang, InnerXML: sp.Value}
+	}
+	return ret, nil
+}
+
+func (s *SidecarPropertyStore) write(p string, props map[xml.Name]Property) error {
+	name := s.sidecar(p)
+
+	if len(props) == 0 {
+		if err := s.Fs.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var sf sidecarFile
+	for _, prop := range props {
+		sf.Props = append(sf.Props, sidecarProperty{
+			Space: prop.Name.Space,
+			Local: prop.Name.Local,
+			Lang:  prop.Lang,
+			Value: prop.InnerXML,
+		})
+	}
+
+	f, err := s.Fs.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write([]byte(xml.Header)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := xml.NewEncoder(f).Encode(sf); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (s *SidecarPropertyStore) Get(p string, name xml.Name) (Property, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	props, err := s.read(p)
+	if err != nil {
+		return Property{}, err
+	}
+
+	prop, ok := props[name]
+	if !ok {
+		return prop, ErrNoSuchProperty
+	}
+	return prop, nil
+}
+
+func (s *SidecarPropertyStore) Set(p string, props ...Property) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.read(p)
+	if err != nil {
+		return err
+	}
+
+	for _, prop := range props {
+		current[prop.Name] = prop
+	}
+	return s.write(p, current)
+}
+
+func (s *SidecarPropertyStore) Remove(p string, names ...xml.Name) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.read(p)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range names {
+		delete(current, n)
+	}
+	return s.write(p, current)
+}
+
+func (s *SidecarPropertyStore) List(p string) ([]Property, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	props, err := s.read(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []Property
+	for _, prop := range props {
+		ret = append(ret, prop)
+	}
+	return ret, nil
+}
+
+func (s *SidecarPropertyStore) Copy(src, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	props, err := s.read(src)
+	if err != nil {
+		return err
+	}
+	return s.write(dst, props)
+}
+
+// Move transfers the sidecar of src, those of its members
+// have already been renamed together with src.
+func (s *SidecarPropertyStore) Move(src, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	props, err := s.read(src)
+	if err != nil {
+		return err
+	}
+	if err := s.write(dst, props); err != nil {
+		return err
+	}
+	return s.write(src, nil)
+}
+
+func (s *SidecarPropertyStore) Delete(p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write(p, nil)
+}
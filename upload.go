@@ -0,0 +1,217 @@
+package webdav
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// name prefix of the temporary files of uploads, followed by 16 hex digits
+const tempPrefix = ".davtmp-"
+
+// is name a temporary file of an upload? Only names created by tempPath are,
+// other files starting with the prefix belong to the clients.
+func isTemp(name string) bool {
+	s := strings.TrimPrefix(path.Base(name), tempPrefix)
+	if len(s) != 16 || len(s) == len(path.Base(name)) {
+		return false
+	}
+
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// path of a new temporary sibling of p
+func tempPath(p string) (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return joinPath(parentPath(p), tempPrefix+hex.EncodeToString(b[:])), nil
+}
+
+// An upload receives the new content of a resource. If the FileSystem is a
+// Renamer it is written to a temporary sibling, which replaces the resource
+// only on commit. Otherwise the resource itself is truncated and written.
+type upload struct {
+	File
+
+	s    *Server
+	path string
+	temp string
+}
+
+// start an upload to p, perm is used for new files
+func (s *Server) startUpload(ctx context.Context, p string, perm os.FileMode) (*upload, error) {
+	if _, ok := s.Fs.(Renamer); !ok {
+		f, err := s.create(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		return &upload{File: f, s: s, path: p}, nil
+	}
+
+	temp, err := tempPath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := s.openFile(ctx, temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &upload{File: f, s: s, path: p, temp: temp}, nil
+}
+
+// commit flushes the content to stable storage and replaces the resource
+func (u *upload) commit() error {
+	if f, ok := u.File.(interface {
+		Sync() error
+	}); ok {
+		if err := f.Sync(); err != nil {
+			u.abort()
+			return err
+		}
+	}
+
+	if err := u.File.Close(); err != nil {
+		u.abort()
+		return err
+	}
+
+	if u.temp == "" {
+		return nil
+	}
+
+	// dead properties stay with the resource, even if they are kept in the file itself
+	s := u.s
+	props := s.pathExists(u.path) && len(s.deadProperties(u.path)) != 0
+	if props {
+		if err := s.Props.Copy(u.path, u.temp); err != nil {
+			u.remove()
+			return err
+		}
+	}
+
+	if err := s.rename(u.temp, u.path); err != nil {
+		u.remove()
+		return err
+	}
+
+	if props {
+		if err := s.Props.Move(u.temp, u.path); err != nil {
+			log.Println("DAV:", "moving properties failed", u.temp, u.path, err)
+		}
+	}
+	return nil
+}
+
+// abort discards the temporary file, the resource keeps its old content
+func (u *upload) abort() {
+	u.File.Close()
+	u.remove()
+}
+
+// failed aborts the upload of a resource that existed before or not. Written
+// in place, the old content is already gone and a new resource is removed again.
+func (u *upload) failed(existed bool) {
+	u.abort()
+	if u.temp != "" {
+		return
+	}
+
+	s := u.s
+	s.resized()
+	if existed {
+		s.forgetChecksums(u.path)
+	} else if err := s.Fs.Remove(u.path); err != nil && !os.IsNotExist(err) {
+		log.Println("DAV:", "removing partial file failed", u.path, err)
+	}
+	s.modified(u.path)
+}
+
+func (u *upload) remove() {
+	if u.temp == "" {
+		return
+	}
+
+	if err := u.s.Fs.Remove(u.temp); err != nil && !os.IsNotExist(err) {
+		log.Println("DAV:", "removing temporary file failed", u.temp, err)
+	}
+	u.s.deleteProperties(u.temp)
+}
+
+// remove temporary files of uploads older than before in the collection p and
+// its members, e.g. left behind by a crash
+func (s *Server) removeTempFiles(p string, before time.Time) {
+	f, err := s.Fs.Open(p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	for {
+		entries, err := f.Readdir(walkBatch)
+		for _, e := range entries {
+			cp := joinPath(p, e.Name())
+
+			switch {
+			case isTemp(e.Name()):
+				// including collections moved aside while being replaced
+				if e.ModTime().Before(before) {
+					if err := s.removeTree(cp); err != nil {
+						log.Println("DAV:", "removing temporary file failed", cp, err)
+					}
+				}
+			case e.IsDir():
+				if !s.hidden(e.Name()) {
+					s.removeTempFiles(cp, before)
+				}
+			}
+		}
+
+		// io.EOF at the end of the directory
+		if err != nil || len(entries) == 0 {
+			return
+		}
+	}
+}
+
+// remove the file or collection p with all its members, hidden ones too, and
+// their dead properties. Used for temporary files, they are no recorded changes.
+func (s *Server) removeTree(p string) error {
+	fi, err := s.stat(p)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		f, err := s.Fs.Open(p)
+		if err != nil {
+			return err
+		}
+		entries, err := f.Readdir(0)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err := s.removeTree(joinPath(p, e.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	s.deleteProperties(p)
+	return s.Fs.Remove(p)
+}
@@ -0,0 +1,140 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+// number of directory entries read at once while walking
+const walkBatch = 100
+
+// stops a walk, returned by its callback
+var errStopWalk = errors.New("walk stopped")
+
+// walk calls fn for the resource p and its members up to depth, in depth-first
+// order. Directories are read in batches, so the tree never has to fit in memory.
+// Members that are the same directory as one of their ancestors, e.g. through a
+// symbolic link, are skipped. Errors of fn stop the walk and are returned, as
+// is the error of ctx once it is done. fn is still called for the resource
+// reached at that moment, so it can report where the walk stopped.
+func (s *Server) walk(ctx context.Context, p string, fi os.FileInfo, depth int, fn func(p string, fi os.FileInfo) error) error {
+	return s.walkMembers(ctx, p, fi, depth, nil, fn)
+}
+
+func (s *Server) walkMembers(ctx context.Context, p string, fi os.FileInfo, depth int, ancestors []os.FileInfo, fn func(p string, fi os.FileInfo) error) error {
+	if err := fn(p, fi); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !fi.IsDir() || depth == 0 {
+		return nil
+	}
+	if depth != InfiniteDepth {
+		depth--
+	}
+	ancestors = append(ancestors, fi)
+
+	f, err := s.open(ctx, p)
+	if err != nil {
+		// vanished in the meantime
+		return ctx.Err()
+	}
+	defer f.Close()
+
+	for {
+		entries, err := f.Readdir(walkBatch)
+		for _, e := range entries {
+			if s.hidden(e.Name()) {
+				continue
+			}
+
+			cp := joinPath(p, e.Name())
+
+			// follows symbolic links, unlike Readdir
+			cfi, err := s.stat(cp)
+			if err != nil {
+				continue
+			}
+
+			cycle := false
+			for _, a := range ancestors {
+				if os.SameFile(a, cfi) {
+					cycle = true
+					break
+				}
+			}
+			if cycle {
+				continue
+			}
+
+			if err := s.walkMembers(ctx, cp, cfi, depth, ancestors, fn); err != nil {
+				return err
+			}
+		}
+
+		// io.EOF at the end of the directory
+		if err != nil || len(entries) == 0 {
+			return nil
+		}
+	}
+}
+
+// walkLimit returns a func to be called for every resource of a walk, it
+// reports whether MaxPropfindNodes or MaxPropfindDuration are exceeded.
+func (s *Server) walkLimit() func() bool {
+	start := time.Now()
+	nodes := 0
+
+	return func() bool {
+		nodes++
+		return (s.MaxPropfindNodes > 0 && nodes > s.MaxPropfindNodes) ||
+			(s.MaxPropfindDuration > 0 && time.Since(start) > s.MaxPropfindDuration)
+	}
+}
+
+// walk the resources of a multistatus response written by fn and finish it.
+// Once the request is canceled or timed out the resource reached is reported
+// with 503 and the multistatus is closed, so the client can continue from
+// there. Only the status is sent if nothing has been written yet.
+func (s *Server) walkResponses(ctx context.Context, w http.ResponseWriter, ms *MultiStatusWriter, p string, fi os.FileInfo, depth int, fn func(p string, fi os.FileInfo) error) {
+	err := s.walk(ctx, p, fi, depth, func(p string, fi os.FileInfo) error {
+		if status := contextStatus(ctx); status != 0 {
+			if !ms.started {
+				return ctx.Err()
+			}
+
+			// an incomplete listing is no state to continue a sync-collection from
+			ms.SyncToken = ""
+
+			ms.Write(Response{
+				Href:                []string{s.href(p, fi.IsDir())},
+				Status:              StatusLine(status),
+				ResponseDescription: "request stopped",
+			})
+			return errStopWalk
+		}
+
+		return fn(p, fi)
+	})
+
+	status := contextStatus(ctx)
+	switch {
+	case err == nil || err == errStopWalk:
+		ms.Close()
+	case status != 0 && !ms.started:
+		w.WriteHeader(status)
+	case status != 0:
+		// stopped right after a response, members of it are missing
+		ms.SyncToken = ""
+		ms.ResponseDescription = "request stopped"
+		ms.Close()
+	}
+	// otherwise the client is gone
+}
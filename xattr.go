@@ -0,0 +1,196 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// prefix of the extended attributes holding dead properties
+const xattrPrefix = "user.dav."
+
+// An XattrPropertyStore keeps the dead properties of a Dir in user extended
+// attributes of the files themselves, e.g. user.dav.{http://example.com/}author,
+// so they are preserved by backups and tools like rsync -X.
+//
+// Resources on file systems without support for extended attributes use the
+// Fallback store, if set, otherwise ErrXattrNotSupported is returned.
+type XattrPropertyStore struct {
+	Dir      Dir
+	Fallback PropertyStore
+}
+
+func NewXattrPropertyStore(d Dir, fallback PropertyStore) *XattrPropertyStore {
+	return &XattrPropertyStore{Dir: d, Fallback: fallback}
+}
+
+// attribute name of a property, namespace qualified in clark notation
+func xattrName(n xml.Name) string {
+	return xattrPrefix + "{" + n.Space + "}" + n.Local
+}
+
+// property name of an attribute, false if it holds no property
+func xattrPropName(attr string) (xml.Name, bool) {
+	s := strings.TrimPrefix(attr, xattrPrefix)
+	if len(s) == len(attr) || !strings.HasPrefix(s, "{") {
+		return xml.Name{}, false
+	}
+
+	i := strings.IndexByte(s, '}')
+	if i < 0 {
+		return xml.Name{}, false
+	}
+	return xml.Name{Space: s[1:i], Local: s[i+1:]}, true
+}
+
+// attribute value: language and xml content separated by a newline
+func xattrValue(p Property) []byte {
+	return []byte(p.Lang + "\n" + p.InnerXML)
+}
+
+func xattrProperty(n xml.Name, v []byte) Property {
+	p := Property{Name: n}
+	if i := strings.IndexByte(string(v), '\n'); i >= 0 {
+		p.Lang, p.InnerXML = string(v[:i]), string(v[i+1:])
+	} else {
+		p.InnerXML = string(v)
+	}
+	return p
+}
+
+// should the fallback store be used?
+func (s *XattrPropertyStore) fallback(err error) bool {
+	return err == ErrXattrNotSupported && s.Fallback != nil
+}
+
+func (s *XattrPropertyStore) Get(p string, name xml.Name) (Property, error) {
+	f, err := s.Dir.sanitizePath(p)
+	if err != nil {
+		return Property{}, err
+	}
+
+	v, err := getxattr(f, xattrName(name))
+	if err != nil {
+		if s.fallback(err) {
+			return s.Fallback.Get(p, name)
+		}
+		return Property{}, err
+	}
+
+	return xattrProperty(name, v), nil
+}
+
+func (s *XattrPropertyStore) Set(p string, props ...Property) error {
+	f, err := s.Dir.sanitizePath(p)
+	if err != nil {
+		return err
+	}
+
+	for _, prop := range props {
+		if err := setxattr(f, xattrName(prop.Name), xattrValue(prop)); err != nil {
+			if s.fallback(err) {
+				return s.Fallback.Set(p, props...)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *XattrPropertyStore) Remove(p string, names ...xml.Name) error {
+	f, err := s.Dir.sanitizePath(p)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range names {
+		if err := removexattr(f, xattrName(n)); err != nil && err != ErrNoSuchProperty {
+			if s.fallback(err) {
+				return s.Fallback.Remove(p, names...)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *XattrPropertyStore) List(p string) ([]Property, error) {
+	f, err := s.Dir.sanitizePath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := listxattr(f)
+	if err != nil {
+		if s.fallback(err) {
+			return s.Fallback.List(p)
+		}
+		return nil, err
+	}
+
+	var ret []Property
+	for _, a := range attrs {
+		n, ok := xattrPropName(a)
+		if !ok {
+			continue
+		}
+
+		v, err := getxattr(f, a)
+		if err != nil {
+			if err == ErrNoSuchProperty {
+				// removed in the meantime
+				continue
+			}
+			return nil, err
+		}
+		ret = append(ret, xattrProperty(n, v))
+	}
+	return ret, nil
+}
+
+// Copy reads the properties of src and writes them to dst, either may
+// reside on a file system without extended attributes.
+func (s *XattrPropertyStore) Copy(src, dst string) error {
+	props, err := s.List(src)
+	if err != nil {
+		return err
+	}
+
+	old, err := s.List(dst)
+	if err != nil {
+		return err
+	}
+
+	names := make([]xml.Name, len(old))
+	for i, p := range old {
+		names[i] = p.Name
+	}
+	if err := s.Remove(dst, names...); err != nil {
+		return err
+	}
+
+	return s.Set(dst, props...)
+}
+
+// Hidden reports whether name is a file of the Fallback store.
+func (s *XattrPropertyStore) Hidden(name string) bool {
+	h, ok := s.Fallback.(interface {
+		Hidden(name string) bool
+	})
+	return ok && h.Hidden(name)
+}
+
+// Move has nothing to do for extended attributes, they are renamed together with the files.
+func (s *XattrPropertyStore) Move(src, dst string) error {
+	if s.Fallback != nil {
+		return s.Fallback.Move(src, dst)
+	}
+	return nil
+}
+
+// Delete has nothing to do for extended attributes, they are removed together with the files.
+func (s *XattrPropertyStore) Delete(p string) error {
+	if s.Fallback != nil {
+		return s.Fallback.Delete(p)
+	}
+	return nil
+}
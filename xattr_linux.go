@@ -0,0 +1,67 @@
+package webdav
+
+import (
+	"strings"
+	"syscall"
+)
+
+// translate errors of the xattr syscalls
+func xattrError(err error) error {
+	switch err {
+	case syscall.ENOTSUP:
+		return ErrXattrNotSupported
+	case syscall.ENODATA:
+		return ErrNoSuchProperty
+	}
+	return err
+}
+
+func getxattr(path, attr string) ([]byte, error) {
+	for {
+		// query size first, value may change in between
+		n, err := syscall.Getxattr(path, attr, nil)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+
+		buf := make([]byte, n)
+		n, err = syscall.Getxattr(path, attr, buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, xattrError(err)
+		}
+		return buf[:n], nil
+	}
+}
+
+func setxattr(path, attr string, value []byte) error {
+	return xattrError(syscall.Setxattr(path, attr, value, 0))
+}
+
+func removexattr(path, attr string) error {
+	return xattrError(syscall.Removexattr(path, attr))
+}
+
+func listxattr(path string) ([]string, error) {
+	for {
+		n, err := syscall.Listxattr(path, nil)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		if n == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n)
+		n, err = syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, xattrError(err)
+		}
+
+		// names are null terminated
+		return strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00"), nil
+	}
+}
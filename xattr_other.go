@@ -0,0 +1,21 @@
+//go:build !linux
+
+package webdav
+
+// extended attributes are only supported on linux, everything goes to the fallback store
+
+func getxattr(path, attr string) ([]byte, error) {
+	return nil, ErrXattrNotSupported
+}
+
+func setxattr(path, attr string, value []byte) error {
+	return ErrXattrNotSupported
+}
+
+func removexattr(path, attr string) error {
+	return ErrXattrNotSupported
+}
+
+func listxattr(path string) ([]string, error) {
+	return nil, ErrXattrNotSupported
+}
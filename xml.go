@@ -0,0 +1,317 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+)
+
+// any element, for Node lookups
+var anyName = xml.Name{Local: "*"}
+
+// PropFind is the request body of PROPFIND, http://www.webdav.org/specs/rfc4918.html#ELEMENT_propfind
+type PropFind struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     PropNames `xml:"DAV: prop"`
+	Include  PropNames `xml:"DAV: include"`
+}
+
+// PropNames are the names of the empty child elements of prop or include.
+type PropNames []xml.Name
+
+func (pn *PropNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	n, err := readNode(d, start, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range n.GetChildrens(anyName) {
+		*pn = append(*pn, c.Name)
+	}
+	return nil
+}
+
+func (pn PropNames) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, n := range pn {
+		if err := e.EncodeElement(struct{}{}, propertyStart(n)); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// PropertyUpdate is the request body of PROPPATCH, http://www.webdav.org/specs/rfc4918.html#ELEMENT_propertyupdate
+type PropertyUpdate struct {
+	XMLName xml.Name
+
+	// set and remove instructions in document order
+	Instructions []PropInstruction
+}
+
+// PropInstruction is a single set or remove element of a PropertyUpdate.
+type PropInstruction struct {
+	Remove bool
+	Props  []Property
+}
+
+func (pu *PropertyUpdate) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	root, err := readNode(d, start, nil)
+	if err != nil {
+		return err
+	}
+
+	if root.Name != davName("propertyupdate") {
+		return ErrMalformedXml
+	}
+	pu.XMLName = root.Name
+
+	for _, n := range root.GetChildrens(anyName) {
+		if n.Name != davName("set") && n.Name != davName("remove") {
+			continue
+		}
+
+		prop := n.FirstChildren(davName("prop"))
+		if prop == nil {
+			return ErrMalformedXml
+		}
+
+		in := PropInstruction{Remove: n.Name == davName("remove")}
+		for _, c := range prop.GetChildrens(anyName) {
+			in.Props = append(in.Props, propertyFromNode(c))
+		}
+
+		if len(in.Props) == 0 {
+			return ErrMalformedXml
+		}
+		pu.Instructions = append(pu.Instructions, in)
+	}
+
+	if len(pu.Instructions) == 0 {
+		return ErrMalformedXml
+	}
+	return nil
+}
+
+func (pu PropertyUpdate) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = davName("propertyupdate")
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	for _, in := range pu.Instructions {
+		name := "set"
+		if in.Remove {
+			name = "remove"
+		}
+
+		v := struct {
+			Prop Prop `xml:"DAV: prop"`
+		}{in.Props}
+		if err := e.EncodeElement(v, xml.StartElement{Name: davName(name)}); err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
+
+// Prop is the content of a prop element, property names and values.
+type Prop []Property
+
+func (p *Prop) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	n, err := readNode(d, start, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range n.GetChildrens(anyName) {
+		*p = append(*p, propertyFromNode(c))
+	}
+	return nil
+}
+
+func (p Prop) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, prop := range p {
+		if err := e.Encode(prop); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func propertyFromNode(n *Node) Property {
+	return Property{
+		Name:     n.Name,
+		Lang:     n.Lang,
+		InnerXML: n.InnerXML(),
+	}
+}
+
+// start element of a property, a property without namespace must
+// not inherit the default namespace of the enclosing element
+func propertyStart(n xml.Name) xml.StartElement {
+	start := xml.StartElement{Name: n}
+	if n.Space == "" {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "xmlns"}}}
+	}
+	return start
+}
+
+func (p *Property) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	n, err := readNode(d, start, nil)
+	if err != nil {
+		return err
+	}
+
+	*p = propertyFromNode(n)
+	return nil
+}
+
+func (p Property) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	v := struct {
+		Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+		InnerXML string `xml:",innerxml"`
+	}{p.Lang, p.InnerXML}
+
+	return e.EncodeElement(v, propertyStart(p.Name))
+}
+
+// LockInfo is the request body of LOCK, http://www.webdav.org/specs/rfc4918.html#ELEMENT_lockinfo
+type LockInfo struct {
+	XMLName   xml.Name  `xml:"DAV: lockinfo"`
+	Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{} `xml:"DAV: lockscope>shared"`
+	Write     *struct{} `xml:"DAV: locktype>write"`
+	Owner     *Owner    `xml:"DAV: owner"`
+}
+
+func (li *LockInfo) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	root, err := readNode(d, start, nil)
+	if err != nil {
+		return err
+	}
+
+	if root.Name != davName("lockinfo") {
+		return ErrMalformedXml
+	}
+	li.XMLName = root.Name
+
+	if scope := root.FirstChildren(davName("lockscope")); scope != nil {
+		if scope.HasChildren(davName("exclusive")) {
+			li.Exclusive = &struct{}{}
+		}
+		if scope.HasChildren(davName("shared")) {
+			li.Shared = &struct{}{}
+		}
+	}
+	if t := root.FirstChildren(davName("locktype")); t != nil && t.HasChildren(davName("write")) {
+		li.Write = &struct{}{}
+	}
+	if owner := root.FirstChildren(davName("owner")); owner != nil {
+		li.Owner = &Owner{InnerXML: owner.InnerXML()}
+	}
+
+	return nil
+}
+
+// Owner is the client supplied information about the creator of a lock.
+type Owner struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+// ActiveLock describes a lock on a resource, http://www.webdav.org/specs/rfc4918.html#ELEMENT_activelock
+type ActiveLock struct {
+	XMLName   xml.Name  `xml:"DAV: activelock"`
+	Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{} `xml:"DAV: lockscope>shared"`
+	Write     *struct{} `xml:"DAV: locktype>write"`
+	Depth     string    `xml:"DAV: depth"`
+	Owner     *Owner    `xml:"DAV: owner"`
+	Timeout   string    `xml:"DAV: timeout,omitempty"`
+	LockToken string    `xml:"DAV: locktoken>href,omitempty"`
+	LockRoot  string    `xml:"DAV: lockroot>href"`
+}
+
+// LockDiscovery is the value of the lockdiscovery property
+type LockDiscovery struct {
+	XMLName     xml.Name     `xml:"DAV: lockdiscovery"`
+	ActiveLocks []ActiveLock `xml:"DAV: activelock"`
+}
+
+// MultiStatus is the body of a 207 Multi-Status response, http://www.webdav.org/specs/rfc4918.html#ELEMENT_multistatus
+type MultiStatus struct {
+	XMLName             xml.Name   `xml:"DAV: multistatus"`
+	Responses           []Response `xml:"DAV: response"`
+	ResponseDescription string     `xml:"DAV: responsedescription,omitempty"`
+}
+
+// Response holds the status of a resource or its properties, http://www.webdav.org/specs/rfc4918.html#ELEMENT_response
+type Response struct {
+	XMLName             xml.Name   `xml:"DAV: response"`
+	Href                []string   `xml:"DAV: href"`
+	Status              string     `xml:"DAV: status,omitempty"`
+	Propstat            []Propstat `xml:"DAV: propstat"`
+	Error               *Error     `xml:"DAV: error"`
+	ResponseDescription string     `xml:"DAV: responsedescription,omitempty"`
+}
+
+// Propstat groups properties with the same status, http://www.webdav.org/specs/rfc4918.html#ELEMENT_propstat
+type Propstat struct {
+	XMLName             xml.Name `xml:"DAV: propstat"`
+	Prop                Prop     `xml:"DAV: prop"`
+	Status              string   `xml:"DAV: status"`
+	Error               *Error   `xml:"DAV: error"`
+	ResponseDescription string   `xml:"DAV: responsedescription,omitempty"`
+}
+
+// Error names the preconditions or postconditions that failed,
+// http://www.webdav.org/specs/rfc4918.html#ELEMENT_error
+type Error struct {
+	XMLName    xml.Name    `xml:"DAV: error"`
+	Conditions []Condition `xml:",any"`
+}
+
+// Condition is a single precondition or postcondition code, some of them
+// list the urls of the affected resources.
+type Condition struct {
+	XMLName xml.Name
+	Href    []string `xml:"DAV: href"`
+}
+
+// decoder of request bodies that fails with ErrExternalEntity on a document
+// type declaration referencing external entities
+// http://www.webdav.org/specs/rfc4918.html#rfc.section.20.6
+func newXmlDecoder(r io.Reader) *xml.Decoder {
+	return xml.NewTokenDecoder(entityFilter{xml.NewDecoder(r)})
+}
+
+type entityFilter struct {
+	d *xml.Decoder
+}
+
+// namespaces are translated by the outer decoder
+func (f entityFilter) Token() (xml.Token, error) {
+	t, err := f.d.RawToken()
+	if d, ok := t.(xml.Directive); ok {
+		if bytes.Contains(d, []byte("SYSTEM")) || bytes.Contains(d, []byte("PUBLIC")) {
+			return nil, ErrExternalEntity
+		}
+	}
+	return t, err
+}
+
+// write v as xml document
+func writeXml(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(v)
+}